@@ -0,0 +1,70 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	smtpHost  = flag.String("smtp-host", "", "SMTP server for email alerts (empty disables email)")
+	smtpPort  = flag.Int("smtp-port", 587, "SMTP server port")
+	smtpUser  = flag.String("smtp-user", "", "SMTP username")
+	smtpPass  = flag.String("smtp-pass", "", "SMTP password")
+	alertFrom = flag.String("alert-from", "", "sender address for email alerts (defaults to -smtp-user)")
+	alertTo   = flag.String("alert-to", "", "comma-separated recipients for email alerts")
+)
+
+// alertInterval is the minimum time between two email alerts.
+const alertInterval = time.Hour
+
+var (
+	lastAlert      time.Time
+	lastAlertMutex sync.Mutex
+)
+
+// sendAlertEmail emails subject and body to -alert-to, at most once per
+// alertInterval. Failures are logged since there is nowhere else to report them.
+func sendAlertEmail(subject, body string) {
+	if *smtpHost == "" || *alertTo == "" {
+		return
+	}
+
+	lastAlertMutex.Lock()
+	if time.Since(lastAlert) < alertInterval {
+		lastAlertMutex.Unlock()
+		slog.Debug("email alert suppressed by rate limit", "subject", subject)
+		return
+	}
+	lastAlert = time.Now()
+	lastAlertMutex.Unlock()
+
+	from := *alertFrom
+	if from == "" {
+		from = *smtpUser
+	}
+	to := strings.Split(*alertTo, ",")
+	for i := range to {
+		to[i] = strings.TrimSpace(to[i])
+	}
+
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\n\r\n%s\r\n",
+		from, strings.Join(to, ", "), subject, time.Now().Format(time.RFC1123Z), body)
+
+	var auth smtp.Auth
+	if *smtpUser != "" {
+		auth = smtp.PlainAuth("", *smtpUser, *smtpPass, *smtpHost)
+	}
+	addr := net.JoinHostPort(*smtpHost, strconv.Itoa(*smtpPort))
+	if err := smtp.SendMail(addr, auth, from, to, []byte(msg)); err != nil {
+		slog.Error("failed to send email alert", "smtp", addr, "error", err)
+		return
+	}
+	slog.Info("sent email alert", "subject", subject, "to", *alertTo)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Role is the level of access granted to an authenticated user. Each role
+// includes the permissions of the ones below it.
+type Role int
+
+const (
+	RoleViewer   Role = iota + 1 // Stream and download clips
+	RoleOperator                 // Also delete clips and restart the camera
+	RoleAdmin                    // Also change camera controls and configuration
+)
+
+// parseRole parses a role name from the users file.
+func parseRole(name string) (Role, error) {
+	switch name {
+	case "viewer":
+		return RoleViewer, nil
+	case "operator":
+		return RoleOperator, nil
+	case "admin":
+		return RoleAdmin, nil
+	default:
+		return 0, fmt.Errorf("unknown role %q", name)
+	}
+}
+
+// account is a user allowed to log in.
+type account struct {
+	password string
+	role     Role
+}
+
+// usersFile is the format of the -auth-users YAML file:
+//
+//	users:
+//	  alice:
+//	    password: secret
+//	    role: operator
+type usersFile struct {
+	Users map[string]struct {
+		Password string `yaml:"password"`
+		Role     string `yaml:"role"`
+	} `yaml:"users"`
+}
+
+// loadAccounts returns the users from -auth-users plus the -auth-user admin.
+// It returns no accounts when authentication is disabled.
+func loadAccounts() (map[string]account, error) {
+	accounts := make(map[string]account)
+	if *authUser != "" {
+		accounts[*authUser] = account{password: *authPass, role: RoleAdmin}
+	}
+	if *authUsersFile == "" {
+		return accounts, nil
+	}
+
+	data, err := os.ReadFile(*authUsersFile)
+	if err != nil {
+		return nil, err
+	}
+	var file usersFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", *authUsersFile, err)
+	}
+	for name, user := range file.Users {
+		role, err := parseRole(user.Role)
+		if err != nil {
+			return nil, fmt.Errorf("user %s: %w", name, err)
+		}
+		accounts[name] = account{password: user.Password, role: role}
+	}
+	return accounts, nil
+}
+
+type roleKey struct{}
+
+// basicAuth requires HTTP basic auth credentials of one of accounts and
+// records the user's role in the request context. Clients in trusted skip
+// authentication and are given the admin role.
+func basicAuth(next http.Handler, accounts map[string]account, trusted []*net.IPNet) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ip := clientIP(r); ip != nil && containsIP(trusted, ip) {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), roleKey{}, RoleAdmin)))
+			return
+		}
+
+		user, pass, ok := r.BasicAuth()
+		acct, known := accounts[user]
+		if !ok || !known || subtle.ConstantTimeCompare([]byte(pass), []byte(acct.password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="camera"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), roleKey{}, acct.role)))
+	})
+}
+
+// requireRole answers 403 Forbidden unless the authenticated user has at
+// least role. Requests are let through when authentication is disabled.
+func requireRole(role Role, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if have, ok := r.Context().Value(roleKey{}).(Role); ok && have < role {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// isAdminPath reports whether path is an administrative route, protected by
+// -admin-token when it is set.
+func isAdminPath(path string) bool {
+	return strings.HasPrefix(path, "/api/") || path == "/restart"
+}
+
+// splitAdminAuth sends requests for administrative routes to admin and all
+// others to public.
+func splitAdminAuth(admin, public http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isAdminPath(r.URL.Path) {
+			admin.ServeHTTP(w, r)
+			return
+		}
+		public.ServeHTTP(w, r)
+	})
+}
+
+// bearerAuth requires "Authorization: Bearer token" and gives the request the
+// admin role.
+func bearerAuth(next http.Handler, token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(strings.TrimSpace(got)), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="camera admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), roleKey{}, RoleAdmin)))
+	})
+}
+
+// requireClientCert rejects requests for /api/* that did not present a
+// client certificate verified against -tls-ca.
+func requireClientCert(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/api/") && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+			http.Error(w, "Client certificate required", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+var (
+	maxBandwidthKbps = flag.Int("max-bandwidth-kbps", 0, "per-client stream bandwidth limit in kilobits per second (0 is unlimited)")
+	bandwidthTimeout = flag.Duration("bandwidth-timeout", 5*time.Second, "drop a client that waits longer than this on its bandwidth limit")
+)
+
+// newBandwidthLimiter returns a token bucket limiting a client to kbps kilobits
+// per second, or nil when kbps is not positive. The bucket holds one second of data.
+func newBandwidthLimiter(kbps int) *rate.Limiter {
+	if kbps <= 0 {
+		return nil
+	}
+	bytesPerSec := kbps * 1000 / 8
+	return rate.NewLimiter(rate.Limit(bytesPerSec), bytesPerSec)
+}
+
+// waitBandwidth blocks until n bytes may be sent through limiter. Frames larger
+// than the bucket are reserved in burst-sized chunks. It returns an error if the
+// reservation cannot be satisfied within timeout or ctx is cancelled.
+func waitBandwidth(ctx context.Context, limiter *rate.Limiter, n int, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for n > 0 {
+		chunk := min(n, limiter.Burst())
+		if err := limiter.WaitN(ctx, chunk); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+const (
+	defaultBandwidthTestKB = 100
+	maxBandwidthTestKB     = 10 * 1024
+)
+
+// bandwidthTestHandler sends ?size_kb= kilobytes of zeros and reports how fast
+// they were written as {"measured_kbps": N} in the X-Bandwidth-Test trailer.
+// Clients can use it to decide whether they can keep up with /stream; the web
+// UI times the download itself, as browsers do not expose trailers to fetch.
+func bandwidthTestHandler(w http.ResponseWriter, r *http.Request) {
+	sizeKB := defaultBandwidthTestKB
+	if s := r.URL.Query().Get("size_kb"); s != "" {
+		var err error
+		sizeKB, err = strconv.Atoi(s)
+		if err != nil || sizeKB < 1 || sizeKB > maxBandwidthTestKB {
+			http.Error(w, "size_kb must be between 1 and "+strconv.Itoa(maxBandwidthTestKB), http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Trailer", "X-Bandwidth-Test")
+	rc := http.NewResponseController(w)
+
+	chunk := make([]byte, 32*1024)
+	remaining := sizeKB * 1024
+	start := time.Now()
+	for remaining > 0 {
+		n := min(remaining, len(chunk))
+		extendWriteDeadline(rc)
+		if _, err := w.Write(chunk[:n]); err != nil {
+			return
+		}
+		if err := rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			return
+		}
+		remaining -= n
+	}
+	elapsed := time.Since(start)
+
+	kbps := float64(sizeKB*1024*8) / 1000 / max(elapsed.Seconds(), 1e-6)
+	result, err := json.Marshal(map[string]float64{"measured_kbps": math.Round(kbps)})
+	if err != nil {
+		slog.Error("failed to encode bandwidth test result", "error", err)
+		return
+	}
+	w.Header().Set("X-Bandwidth-Test", string(result))
+	slog.Debug("bandwidth test", "client", r.RemoteAddr, "size_kb", sizeKB, "elapsed", elapsed, "kbps", kbps)
+}
@@ -0,0 +1,247 @@
+//go:build !recorder
+
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	clientTimeout       = flag.Duration("client-timeout", time.Minute, "remove stream clients that have frames waiting but finished no write for this long, such as half-open connections (0 disables)")
+	clientCheckInterval = flag.Duration("client-check-interval", 30*time.Second, "how often stream clients are checked against -client-timeout")
+)
+
+// clientShard is a subset of the stream clients with its own lock and
+// goroutine, so one slow shard does not hold up frame delivery to the others.
+type clientShard struct {
+	mutex   sync.Mutex
+	clients map[*streamClient]struct{}
+	frames  chan []byte
+}
+
+// streamClient is a stream client registered with a shard. Its channel is
+// replaced by reallocateClientBuffers, so it is only accessed with the shard
+// locked; the client reads from the channel returned by addClient or next.
+type streamClient struct {
+	frames    ClientChan
+	info      clientInfo
+	lastWrite atomic.Int64 // Unix nanoseconds of the last frame written, or of connecting
+	abort     func()       // Interrupts a write blocked on the client's connection
+}
+
+// shardBuffer is how many frames a shard queues before broadcastFrame waits
+// for it.
+const shardBuffer = 4
+
+var (
+	clientShards []*clientShard
+	nextShard    atomic.Uint64 // Round-robin counter for assigning clients to shards
+)
+
+// startBroadcastShards starts n shard goroutines. It must be called before
+// frameBroadcaster or imageServ run.
+func startBroadcastShards(n int) {
+	for range n {
+		shard := &clientShard{
+			clients: make(map[*streamClient]struct{}),
+			frames:  make(chan []byte, shardBuffer),
+		}
+		clientShards = append(clientShards, shard)
+		go shard.run()
+	}
+}
+
+// broadcastFrame hands frame to every shard. Shards never drop frames: a shard
+// with a full queue holds up the broadcaster, as the single client loop did
+// before sharding. Frames are only dropped for clients whose own channel is
+// full.
+func broadcastFrame(frame []byte) {
+	if newCap, ok := frameSizes.observe(len(frame)); ok {
+		reallocateClientBuffers(newCap)
+	}
+	for _, shard := range clientShards {
+		shard.frames <- frame
+	}
+}
+
+// run sends each frame received by the shard to all of its clients.
+func (s *clientShard) run() {
+	defer logPanic("clientShard")
+
+	for frame := range s.frames {
+		s.mutex.Lock()
+		for client := range s.clients {
+			select {
+			case client.frames <- frame:
+			default:
+				slog.Debug("client channel full, dropping frame")
+			}
+		}
+		s.mutex.Unlock()
+	}
+}
+
+// addClient registers a client with the next shard. abort, if not nil, is
+// called when clientWatchdog removes the client. It returns the shard, the
+// client and the channel to read the client's frames from.
+func addClient(info clientInfo, abort func()) (*clientShard, *streamClient, ClientChan) {
+	client := &streamClient{frames: make(ClientChan, clientCapacity.Load()), info: info, abort: abort}
+	client.lastWrite.Store(time.Now().UnixNano())
+	shard := clientShards[nextShard.Add(1)%uint64(len(clientShards))]
+	shard.mutex.Lock()
+	shard.clients[client] = struct{}{}
+	shard.mutex.Unlock()
+	return shard, client, client.frames
+}
+
+// next returns the channel that replaced a client's closed channel, or nil if
+// the client has been removed.
+func (s *clientShard) next(client *streamClient) ClientChan {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.clients[client]; !ok {
+		return nil
+	}
+	return client.frames
+}
+
+// removeClient unregisters client and closes its channel. It does nothing if
+// the client was already removed.
+func (s *clientShard) removeClient(client *streamClient) {
+	s.mutex.Lock()
+	if _, ok := s.clients[client]; ok {
+		delete(s.clients, client)
+		close(client.frames)
+	}
+	s.mutex.Unlock()
+}
+
+// clientWatchdog checks the clients every -client-check-interval and removes
+// those that have frames waiting but have not finished a write within
+// -client-timeout. Such a client is stuck on a connection that no longer
+// drains, like a half-open one.
+func clientWatchdog() {
+	defer logPanic("clientWatchdog")
+
+	if *clientTimeout <= 0 {
+		return
+	}
+	for range time.Tick(*clientCheckInterval) {
+		cutoff := time.Now().Add(-*clientTimeout).UnixNano()
+		for _, shard := range clientShards {
+			shard.mutex.Lock()
+			for client := range shard.clients {
+				lastWrite := client.lastWrite.Load()
+				if len(client.frames) == 0 || lastWrite > cutoff {
+					continue
+				}
+				slog.Warn("removing stale stream client", "client", client.info.remoteAddr, "last_write", time.Unix(0, lastWrite))
+				delete(shard.clients, client)
+				close(client.frames)
+				if client.abort != nil {
+					client.abort()
+				}
+			}
+			shard.mutex.Unlock()
+		}
+	}
+}
+
+// viewerCount returns the number of clients receiving frames.
+func viewerCount() int {
+	n := 0
+	for _, shard := range clientShards {
+		shard.mutex.Lock()
+		n += len(shard.clients)
+		shard.mutex.Unlock()
+	}
+	return n
+}
+
+// clientCapacity is the buffer size of client channels, starting at
+// -client-buffer and grown by reallocateClientBuffers.
+var clientCapacity atomic.Int64
+
+// Average frame sizes are calibrated over the first calibrationFrames frames.
+// Once the running average exceeds the calibration by frameGrowthRatio, client
+// buffers are grown by the same ratio, up to maxBufferGrowth times
+// -client-buffer, and the calibration starts over from the new average.
+const (
+	calibrationFrames = 100
+	frameGrowthRatio  = 1.5
+	maxBufferGrowth   = 4
+)
+
+// frameSizeTracker follows the average frame size. It is only used by the
+// frameBroadcaster goroutine.
+type frameSizeTracker struct {
+	count      int
+	sum        int
+	calibrated float64 // Average size of the calibration frames, 0 until calibrated
+	average    float64 // Exponentially weighted average after calibration
+}
+
+var frameSizes frameSizeTracker
+
+// observe adds a frame of size bytes to the average. It returns the new client
+// buffer capacity when the frames have grown enough to warrant reallocation.
+func (t *frameSizeTracker) observe(size int) (int, bool) {
+	if t.calibrated == 0 {
+		t.count++
+		t.sum += size
+		if t.count == calibrationFrames {
+			t.calibrated = float64(t.sum) / calibrationFrames
+			t.average = t.calibrated
+		}
+		return 0, false
+	}
+
+	t.average += (float64(size) - t.average) / calibrationFrames
+	if t.average <= t.calibrated*frameGrowthRatio {
+		return 0, false
+	}
+	ratio := t.average / t.calibrated
+	t.calibrated = t.average
+
+	current := int(clientCapacity.Load())
+	newCap := min(int(float64(current)*ratio), clientBuffer*maxBufferGrowth)
+	if newCap <= current {
+		return 0, false
+	}
+	slog.Info("average frame size grew, reallocating client buffers",
+		"average_bytes", int(t.average), "old_capacity", current, "new_capacity", newCap)
+	return newCap, true
+}
+
+// reallocateClientBuffers replaces every client's channel with one of
+// capacity n. All shards are locked while the buffered frames are moved over,
+// and each old channel is closed so its reader picks up the new one.
+func reallocateClientBuffers(n int) {
+	clientCapacity.Store(int64(n))
+	for _, shard := range clientShards {
+		shard.mutex.Lock()
+	}
+	for _, shard := range clientShards {
+		for client := range shard.clients {
+			frames := make(ClientChan, n)
+		drain:
+			for {
+				select {
+				case frame := <-client.frames:
+					frames <- frame
+				default:
+					break drain
+				}
+			}
+			close(client.frames)
+			client.frames = frames
+		}
+	}
+	for _, shard := range clientShards {
+		shard.mutex.Unlock()
+	}
+}
@@ -0,0 +1,123 @@
+//go:build !recorder
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"math/rand"
+	"testing"
+)
+
+// benchJPEG returns a noisy w×h JPEG, about the size of a camera frame.
+func benchJPEG(b *testing.B, w, h int) []byte {
+	img := image.NewYCbCr(image.Rect(0, 0, w, h), image.YCbCrSubsampleRatio420)
+	rng := rand.New(rand.NewSource(1))
+	for i := range img.Y {
+		img.Y[i] = uint8(i/w) + uint8(rng.Intn(16))
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 80}); err != nil {
+		b.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// BenchmarkFrameBroadcaster measures how fast frames get from the camera to n
+// clients. Each frame is sent once every client has the previous one, since
+// clients whose channel is full miss frames. Run it with -race to check the
+// broadcaster and shards as well.
+func BenchmarkFrameBroadcaster(b *testing.B) {
+	*warmupFrames = 0
+	sizes := []struct {
+		name string
+		w, h int
+	}{
+		{"720p", 1280, 720},
+		{"1080p", 1920, 1080},
+	}
+	for _, size := range sizes {
+		frame := benchJPEG(b, size.w, size.h)
+		for _, n := range []int{1, 5, 10, 50} {
+			b.Run(fmt.Sprintf("%s/clients=%d", size.name, n), func(b *testing.B) {
+				clientCapacity.Store(int64(clientBuffer))
+				clientShards = nil
+				startBroadcastShards(broadcastShards)
+
+				delivered := make(chan struct{}, n)
+				for range n {
+					shard, client, ch := addClient(clientInfo{}, nil)
+					defer shard.removeClient(client)
+					go func() {
+						for ch != nil {
+							for range ch {
+								delivered <- struct{}{}
+							}
+							ch = shard.next(client)
+						}
+					}()
+				}
+
+				camera := newFakeCamera()
+				done := make(chan struct{})
+				go func() {
+					broadcastCamera(camera)
+					close(done)
+				}()
+
+				b.SetBytes(int64(len(frame) * n))
+				b.ResetTimer()
+				for range b.N {
+					camera.frames <- frame
+					for range n {
+						<-delivered
+					}
+				}
+				b.StopTimer()
+				camera.Close()
+				<-done
+				b.ReportMetric(float64(b.N*n)/b.Elapsed().Seconds(), "frames/s")
+			})
+		}
+	}
+}
+
+// BenchmarkBroadcastShards measures how fast frames reach 50 clients with
+// -broadcast-shards set to 1, 2, 4 and 8.
+func BenchmarkBroadcastShards(b *testing.B) {
+	const n = 50
+	frame := benchJPEG(b, 1280, 720)
+	for _, shards := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			clientCapacity.Store(int64(clientBuffer))
+			clientShards = nil
+			startBroadcastShards(shards)
+
+			delivered := make(chan struct{}, n)
+			for range n {
+				shard, client, ch := addClient(clientInfo{}, nil)
+				defer shard.removeClient(client)
+				go func() {
+					for ch != nil {
+						for range ch {
+							delivered <- struct{}{}
+						}
+						ch = shard.next(client)
+					}
+				}()
+			}
+
+			b.ResetTimer()
+			for range b.N {
+				broadcastFrame(frame)
+				for range n {
+					<-delivered
+				}
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(b.N*n)/b.Elapsed().Seconds(), "frames/s")
+		})
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/vladimirvivien/go4vl/device"
+	"github.com/vladimirvivien/go4vl/v4l2"
+)
+
+var (
+	cameraName    = flag.String("camera-name", "Pi Camera", "name identifying this camera in pages, overlays, webhooks and alerts")
+	cameraRetries = flag.Int("camera-retries", 3, "attempts to open the camera before giving up and sending an alert")
+	fpsCap        = flag.Int("fps-cap", 0, "maximum frames per second taken from the camera, for drivers that ignore the requested rate (0 disables)")
+	warmupFrames  = flag.Int("warmup-frames", 10, "frames discarded after the camera starts while exposure and white balance settle")
+	openRetries   = flag.Int("open-retries", 5, "extra attempts at opening the video device at boot, for USB cameras still being enumerated")
+	openTimeout   = flag.Duration("open-timeout", 10*time.Second, "give up retrying to open the video device at boot after this long")
+	exitOnFailure = flag.Bool("exit-on-camera-failure", false, "exit after repeated restarts without frames so a supervisor such as systemd restarts the process")
+)
+
+// Camera states reported on /healthz.
+const (
+	stateStarting   = "starting"
+	stateRunning    = "running"
+	stateRestarting = "restarting"
+	stateFailed     = "failed"
+)
+
+const (
+	minRestartBackoff = time.Second
+	maxRestartBackoff = 60 * time.Second
+
+	restartFrameTimeout  = 5 * time.Second // How long a restarted camera has to deliver a frame
+	maxFramelessRestarts = 3               // Consecutive frameless restarts before alerting
+)
+
+var (
+	cameraDevice *device.Device  // Current camera, guarded by cameraMutex
+	devName      = "/dev/video0" // Camera device, set with -device
+
+	cameraMutex      sync.RWMutex
+	cameraState      = stateStarting
+	cameraReady      = make(chan struct{}) // Closed while the camera is running
+	cameraRestarting bool                  // Set while restartCamera's goroutine is retrying
+
+	framelessRestarts atomic.Int32 // Consecutive restarts that produced no frames
+	failoverName      atomic.Value // Name of the device standing in for devName, if any
+)
+
+// setupCamera initializes the camera device and starts the stream.
+func setupCamera() (*device.Device, error) {
+	return openDevice(devName)
+}
+
+// openRetryStep is added to the wait after every failed attempt to open the
+// device at startup.
+const openRetryStep = 500 * time.Millisecond
+
+// openDevice opens the V4L2 device name for 720p capture in -pixel-format and
+// starts it.
+func openDevice(name string) (*device.Device, error) {
+	camera, err := device.Open(
+		name,
+		device.WithPixFormat(v4l2.PixFormat{PixelFormat: pixelFormats[*pixelFormat], Width: 1280, Height: 720}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if format, err := camera.GetPixFormat(); err == nil && format.PixelFormat != pixelFormats[*pixelFormat] {
+		camera.Close()
+		return nil, fmt.Errorf("device does not capture %s, it offered %s", *pixelFormat, fourCC(format.PixelFormat))
+	}
+
+	if err := camera.Start(context.TODO()); err != nil {
+		camera.Close()
+		return nil, fmt.Errorf("camera start: %w", err)
+	}
+
+	return camera, nil
+}
+
+// openBootDevice opens the device name like openDevice, retrying up to
+// -open-retries times within -open-timeout and waiting openRetryStep longer
+// after each attempt, for USB cameras still being enumerated at boot. Restarts
+// and failover use openDevice, so a missing device does not hold them up.
+func openBootDevice(name string) (*device.Device, error) {
+	deadline := time.Now().Add(*openTimeout)
+	for attempt := 1; ; attempt++ {
+		camera, err := openDevice(name)
+		if err == nil {
+			return camera, nil
+		}
+		delay := time.Duration(attempt) * openRetryStep
+		if attempt > *openRetries || time.Now().Add(delay).After(deadline) {
+			return nil, fmt.Errorf("failed to open device after %d attempts: %w", attempt, err)
+		}
+		slog.Debug("failed to open device, retrying", "device", name, "attempt", attempt, "retry_in", delay, "error", err)
+		time.Sleep(delay)
+	}
+}
+
+// openCamera opens the camera at startup: with openBootDevice, then with
+// setupCamera up to -camera-retries times in all, one second apart. It sends
+// an email alert if every attempt fails. The opened camera becomes the
+// current one.
+func openCamera() error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		var camera *device.Device
+		if attempt == 1 {
+			camera, err = openBootDevice(devName)
+		} else {
+			camera, err = setupCamera()
+		}
+		if err == nil {
+			probeCapabilities(camera)
+			setCameraRunning(camera)
+			return nil
+		}
+		if attempt >= *cameraRetries {
+			break
+		}
+		slog.Warn("failed to open camera, retrying", "device", devName, "attempt", attempt, "error", err)
+		time.Sleep(time.Second)
+	}
+
+	setCameraState(stateFailed)
+	sendCameraAlert(err)
+	return err
+}
+
+// closeCamera closes the current camera on shutdown.
+func closeCamera() {
+	cameraMutex.RLock()
+	camera := cameraDevice
+	cameraMutex.RUnlock()
+	if camera != nil {
+		camera.Close()
+	}
+}
+
+// sendCameraAlert emails err as the reason the camera could not be opened.
+func sendCameraAlert(err error) {
+	sendAlertEmail(
+		fmt.Sprintf("%s: camera %s failed", *cameraName, devName),
+		fmt.Sprintf("Could not open camera %s after %d attempts: %s", devName, *cameraRetries, err),
+	)
+}
+
+// setCameraState records the camera state. Leaving the running state makes
+// waitForCamera block until setCameraRunning is called again.
+func setCameraState(state string) {
+	cameraMutex.Lock()
+	defer cameraMutex.Unlock()
+	if cameraState == stateRunning && state != stateRunning {
+		cameraReady = make(chan struct{})
+	}
+	cameraState = state
+}
+
+// setCameraRunning publishes camera as the current device and wakes up
+// waitForCamera callers.
+func setCameraRunning(camera *device.Device) {
+	cameraMutex.Lock()
+	defer cameraMutex.Unlock()
+	cameraDevice = camera
+	if cameraState != stateRunning {
+		close(cameraReady)
+	}
+	cameraState = stateRunning
+	cameraRestarting = false
+}
+
+// frameSource is the part of *device.Device the frame broadcaster uses.
+type frameSource interface {
+	GetOutput() <-chan []byte
+	GetPixFormat() (v4l2.PixFormat, error)
+	Close() error
+}
+
+// waitForCamera blocks until the camera is running and returns it. A device's
+// output channel is created by Start before the device is published, so its
+// GetOutput needs no lock.
+func waitForCamera() *device.Device {
+	for {
+		cameraMutex.RLock()
+		state, camera, ready := cameraState, cameraDevice, cameraReady
+		cameraMutex.RUnlock()
+		if state == stateRunning {
+			return camera
+		}
+		<-ready
+	}
+}
+
+// restartCamera closes the camera device and reopens it in the background,
+// backing off exponentially with jitter between failed attempts so a broken
+// device is not hammered. It does nothing if a restart is already in progress.
+func restartCamera() {
+	cameraMutex.Lock()
+	if cameraRestarting {
+		cameraMutex.Unlock()
+		return
+	}
+	cameraRestarting = true
+	camera := cameraDevice
+	cameraMutex.Unlock()
+	setCameraState(stateRestarting)
+
+	go func() {
+		defer logPanic("restartCamera")
+
+		if camera != nil {
+			camera.Close()
+		}
+
+		backoff := minRestartBackoff
+		for attempt := 1; ; attempt++ {
+			camera, err := setupCamera()
+			if err == nil {
+				restarted := time.Now()
+				setCameraRunning(camera)
+				slog.Info("camera restarted", "device", devName, "attempts", attempt)
+				checkRestartFrames(restarted)
+				return
+			}
+
+			delay := backoff + rand.N(backoff/2)
+			slog.Error("failed to restart camera", "device", devName, "attempt", attempt, "retry_in", delay, "error", err)
+			if attempt == *cameraRetries {
+				setCameraState(stateFailed)
+				sendCameraAlert(err)
+			}
+			time.Sleep(delay)
+			backoff = min(backoff*2, maxRestartBackoff)
+		}
+	}()
+}
+
+// checkRestartFrames waits restartFrameTimeout for a frame to arrive after a
+// restart at restarted and restarts the camera again if none does. When
+// maxFramelessRestarts in a row is reached it sends a webhook alert, once
+// until a frame arrives, and, with -exit-on-camera-failure, exits.
+func checkRestartFrames(restarted time.Time) {
+	time.Sleep(restartFrameTimeout)
+	if lastFrameTime().After(restarted) {
+		framelessRestarts.Store(0)
+		return
+	}
+
+	failures := framelessRestarts.Add(1)
+	slog.Error("camera restart succeeded but no frames received, retrying", "device", devName, "consecutive_failures", failures)
+	if failures == maxFramelessRestarts {
+		err := sendWebhook(map[string]any{
+			"event":     "camera_failure",
+			"timestamp": time.Now().Format(time.RFC3339),
+			"device":    devName,
+			"restarts":  failures,
+		})
+		if err != nil {
+			slog.Error("failed to send camera failure webhook", "error", err)
+		}
+		if *exitOnFailure {
+			fatal("camera produces no frames after restarting, exiting", "device", devName, "restarts", failures)
+		}
+	}
+	restartCamera()
+}
+
+// capFrameRate sleeps until a frame interval of -fps-cap has passed since last
+// and returns the time it finished, to be passed back in for the next frame.
+func capFrameRate(last time.Time) time.Time {
+	if *fpsCap > 0 {
+		interval := time.Second / time.Duration(*fpsCap)
+		time.Sleep(max(0, interval-time.Since(last)))
+	}
+	return time.Now()
+}
+
+// activeDevice returns the name of the device currently being recorded.
+func activeDevice() string {
+	if name, ok := failoverName.Load().(string); ok && name != "" {
+		return name
+	}
+	return devName
+}
+
+// healthzHandler reports the camera state, active device and frame rate. The
+// status is degraded while the frame rate is too low, and failed, with a 503,
+// once the camera has failed.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	cameraMutex.RLock()
+	state := cameraState
+	cameraMutex.RUnlock()
+
+	status := "ok"
+	if state == stateFailed {
+		status = "failed"
+	} else if state == stateRunning && fpsDegraded.Load() {
+		status = "degraded"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if state == stateFailed {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	err := json.NewEncoder(w).Encode(map[string]any{
+		"status":        status,
+		"camera":        state,
+		"active_device": activeDevice(),
+		"fps":           currentFPS(),
+	})
+	if err != nil {
+		slog.Error("failed to encode health status", "error", err)
+	}
+}
+
+// resetCameraWeb restarts the camera. frameBroadcaster picks up the reopened
+// device once it is running.
+func resetCameraWeb(w http.ResponseWriter, req *http.Request) {
+	slog.Info("camera restart requested", "remote_addr", req.RemoteAddr)
+	restartCamera()
+	fmt.Fprint(w, "Camera restarted.")
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync/atomic"
+
+	"github.com/vladimirvivien/go4vl/device"
+)
+
+// cameraCapabilities describes the camera opened at startup.
+type cameraCapabilities struct {
+	Device  string         `json:"device"`
+	Name    string         `json:"name"`
+	Driver  string         `json:"driver"`
+	BusInfo string         `json:"bus_info"`
+	Formats []deviceFormat `json:"formats"`
+}
+
+var capabilities atomic.Pointer[cameraCapabilities]
+
+// probeCapabilities enumerates the formats, frame sizes and frame rates of
+// camera, logs them and keeps them for /api/camera/capabilities.
+func probeCapabilities(camera *device.Device) {
+	capability := camera.Capability()
+	caps := &cameraCapabilities{
+		Device:  camera.Name(),
+		Name:    capability.Card,
+		Driver:  capability.Driver,
+		BusInfo: capability.BusInfo,
+	}
+	formats, err := deviceFormats(camera.Fd())
+	if err != nil {
+		slog.Warn("failed to enumerate camera formats", "device", caps.Device, "error", err)
+	}
+	caps.Formats = formats
+	capabilities.Store(caps)
+
+	slog.Info("camera capabilities", "device", caps.Device, "name", caps.Name, "driver", caps.Driver, "bus_info", caps.BusInfo)
+	for _, format := range formats {
+		var resolutions []string
+		minFPS, maxFPS := 0.0, 0.0
+		for _, size := range format.FrameSizes {
+			if size.Type == "discrete" {
+				resolutions = append(resolutions, fmt.Sprintf("%dx%d", size.Width, size.Height))
+			} else {
+				resolutions = append(resolutions, fmt.Sprintf("%dx%d-%dx%d", size.MinWidth, size.MinHeight, size.MaxWidth, size.MaxHeight))
+			}
+			for _, fps := range slices.Concat(size.FPS, []float64{size.MinFPS, size.MaxFPS}) {
+				if fps <= 0 {
+					continue
+				}
+				if minFPS == 0 || fps < minFPS {
+					minFPS = fps
+				}
+				maxFPS = max(maxFPS, fps)
+			}
+		}
+		slog.Info("camera format", "pixel_format", format.PixelFormat, "description", format.Description,
+			"resolutions", resolutions, "min_fps", minFPS, "max_fps", maxFPS)
+	}
+}
+
+// cameraCapabilitiesHandler serves the capabilities of the camera as probed at
+// startup.
+func cameraCapabilitiesHandler(w http.ResponseWriter, r *http.Request) {
+	caps := capabilities.Load()
+	if caps == nil {
+		http.Error(w, "Camera capabilities unknown", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(caps); err != nil {
+		slog.Error("failed to encode camera capabilities", "error", err)
+	}
+}
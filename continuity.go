@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log/slog"
+	"math"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+)
+
+var minContinuityPercent = flag.Float64("min-continuity-percent", 0, "send a webhook alert when the previous day's recording continuity is below this percentage (0 disables)")
+
+// clipTimePattern matches the timestamp FFmpeg writes into segment names.
+var clipTimePattern = regexp.MustCompile(`\d{8}T\d{6}`)
+
+// clipSpan is the time range covered by a single recorded clip.
+type clipSpan struct {
+	Name  string
+	Start time.Time
+	End   time.Time
+}
+
+// continuityGap is a period of the day not covered by any clip.
+type continuityGap struct {
+	Start   string `json:"start"`
+	End     string `json:"end"`
+	Seconds int    `json:"seconds"`
+}
+
+// continuityReport is the recording continuity for a single day.
+type continuityReport struct {
+	Date            string          `json:"date"`
+	CoveragePercent float64         `json:"coverage_percent"`
+	Gaps            []continuityGap `json:"gaps"`
+}
+
+// clipManifest returns the spans of all clips in the clip store sorted by start
+// time. A clip starts at the time encoded in its name and ends at its last
+// modification.
+func clipManifest() ([]clipSpan, error) {
+	clips, err := clipStore.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var spans []clipSpan
+	for _, clip := range clips {
+		if filepath.Ext(clip.Name) != clipExt() {
+			continue
+		}
+		stamp := clipTimePattern.FindString(clip.Name)
+		if stamp == "" {
+			continue
+		}
+		start, err := time.ParseInLocation("20060102T150405", stamp, time.Local)
+		if err != nil {
+			continue
+		}
+		if clip.ModTime.Before(start) {
+			continue
+		}
+		spans = append(spans, clipSpan{Name: clip.Name, Start: start, End: clip.ModTime})
+	}
+
+	sort.Slice(spans, func(i, j int) bool { return spans[i].Start.Before(spans[j].Start) })
+	return spans, nil
+}
+
+// computeContinuity measures how much of day was recorded. The measured window
+// starts at midnight or the first clip, whichever is later, and ends at the end
+// of the day or now, whichever is earlier.
+func computeContinuity(spans []clipSpan, day time.Time, now time.Time) continuityReport {
+	dayStart := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, day.Location())
+	dayEnd := dayStart.AddDate(0, 0, 1)
+	report := continuityReport{Date: dayStart.Format("2006-01-02"), Gaps: []continuityGap{}}
+
+	if len(spans) == 0 {
+		return report
+	}
+	windowStart := dayStart
+	if spans[0].Start.After(windowStart) {
+		windowStart = spans[0].Start
+	}
+	windowEnd := dayEnd
+	if now.Before(windowEnd) {
+		windowEnd = now
+	}
+	if !windowEnd.After(windowStart) {
+		return report
+	}
+
+	var covered time.Duration
+	cursor := windowStart
+	for _, span := range spans {
+		start, end := span.Start, span.End
+		if start.Before(cursor) {
+			start = cursor
+		}
+		if end.After(windowEnd) {
+			end = windowEnd
+		}
+		if !end.After(start) {
+			continue
+		}
+		if start.After(cursor) {
+			report.Gaps = append(report.Gaps, newContinuityGap(cursor, start))
+		}
+		covered += end.Sub(start)
+		cursor = end
+	}
+	if windowEnd.After(cursor) {
+		report.Gaps = append(report.Gaps, newContinuityGap(cursor, windowEnd))
+	}
+
+	percent := 100 * covered.Seconds() / windowEnd.Sub(windowStart).Seconds()
+	report.CoveragePercent = math.Round(percent*10) / 10
+	return report
+}
+
+func newContinuityGap(start, end time.Time) continuityGap {
+	return continuityGap{
+		Start:   start.Format("15:04"),
+		End:     end.Format("15:04"),
+		Seconds: int(end.Sub(start).Seconds()),
+	}
+}
+
+// continuityHandler serves the recording continuity for the day given by the
+// date query parameter (YYYY-MM-DD), defaulting to today.
+func continuityHandler(w http.ResponseWriter, r *http.Request) {
+	day := time.Now()
+	if date := r.URL.Query().Get("date"); date != "" {
+		var err error
+		day, err = time.ParseInLocation("2006-01-02", date, time.Local)
+		if err != nil {
+			http.Error(w, "Invalid date, expected YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+	}
+
+	spans, err := clipManifest()
+	if err != nil {
+		http.Error(w, "Unable to read directory", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(computeContinuity(spans, day, time.Now())); err != nil {
+		slog.Error("failed to encode continuity report", "error", err)
+	}
+}
+
+// continuityMonitor checks the previous day's continuity shortly after each
+// midnight and sends a webhook alert when it is below -min-continuity-percent.
+func continuityMonitor() {
+	defer logPanic("continuityMonitor")
+
+	if *minContinuityPercent <= 0 {
+		return
+	}
+	for {
+		now := time.Now()
+		midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
+		time.Sleep(midnight.Sub(now) + time.Minute)
+
+		spans, err := clipManifest()
+		if err != nil {
+			slog.Error("failed to read clip manifest", "error", err)
+			continue
+		}
+		report := computeContinuity(spans, midnight.AddDate(0, 0, -1), midnight)
+		slog.Info("daily recording continuity", "date", report.Date, "coverage_percent", report.CoveragePercent, "gaps", len(report.Gaps))
+		if report.CoveragePercent >= *minContinuityPercent {
+			continue
+		}
+
+		err = sendWebhook(map[string]any{
+			"event":            "continuity",
+			"timestamp":        time.Now().Format(time.RFC3339),
+			"date":             report.Date,
+			"coverage_percent": report.CoveragePercent,
+			"threshold":        *minContinuityPercent,
+			"gaps":             report.Gaps,
+		})
+		if err != nil {
+			slog.Error("failed to send continuity alert", "date", report.Date, "error", err)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var (
+	dashEnabled    = flag.Bool("dash", false, "serve an adaptive MPEG-DASH stream at /dash/manifest.mpd")
+	dashRenditions = flag.String("dash-renditions", "1280x720:2M,640x360:500k", "comma-separated WIDTHxHEIGHT:BITRATE representations of the DASH stream")
+)
+
+// dashRendition is one representation of the DASH stream.
+type dashRendition struct {
+	Width, Height int
+	Bitrate       string
+}
+
+// parseDashRenditions parses -dash-renditions.
+func parseDashRenditions(s string) ([]dashRendition, error) {
+	var renditions []dashRendition
+	for _, spec := range strings.Split(s, ",") {
+		size, bitrate, ok := strings.Cut(strings.TrimSpace(spec), ":")
+		if !ok || bitrate == "" {
+			return nil, fmt.Errorf("rendition %q: expected WIDTHxHEIGHT:BITRATE", spec)
+		}
+		w, h, ok := strings.Cut(size, "x")
+		width, errW := strconv.Atoi(w)
+		height, errH := strconv.Atoi(h)
+		if !ok || errW != nil || errH != nil || width <= 0 || height <= 0 {
+			return nil, fmt.Errorf("rendition %q: invalid size %q", spec, size)
+		}
+		renditions = append(renditions, dashRendition{Width: width, Height: height, Bitrate: bitrate})
+	}
+	return renditions, nil
+}
+
+// dashFrames feeds frames from frameBroadcaster to the DASH FFmpeg process.
+// It is nil while DASH is disabled.
+var dashFrames chan []byte
+
+// dashArgs returns the arguments for the FFmpeg process writing the DASH
+// manifest and segments for renditions into dir.
+func dashArgs(dir string, renditions []dashRendition) []string {
+	var filter strings.Builder
+	fmt.Fprintf(&filter, "[0:v]split=%d", len(renditions))
+	for i := range renditions {
+		fmt.Fprintf(&filter, "[in%d]", i)
+	}
+	for i, r := range renditions {
+		fmt.Fprintf(&filter, ";[in%d]scale=%d:%d[out%d]", i, r.Width, r.Height, i)
+	}
+
+	args := []string{
+		"-hide_banner",
+		"-loglevel", "level+error",
+		"-f", "mjpeg",
+		"-framerate", "15",
+		"-i", "pipe:0",
+		"-filter_complex", filter.String(),
+	}
+	for i, r := range renditions {
+		args = append(args,
+			"-map", fmt.Sprintf("[out%d]", i),
+			fmt.Sprintf("-c:v:%d", i), "libx264",
+			fmt.Sprintf("-b:v:%d", i), r.Bitrate,
+		)
+	}
+	return append(args,
+		"-preset", "veryfast",
+		"-tune", "zerolatency",
+		"-pix_fmt", "yuv420p",
+		"-g", "30", // Keyframe every segment so representations can switch
+		"-f", "dash",
+		"-seg_duration", "2",
+		"-window_size", "5",
+		"-extra_window_size", "5",
+		"-use_template", "1",
+		"-use_timeline", "1",
+		"-remove_at_exit", "1",
+		"-adaptation_sets", "id=0,streams=v",
+		filepath.Join(dir, "manifest.mpd"),
+	)
+}
+
+// startDash starts the DASH FFmpeg process in a temporary directory and serves
+// that directory at /dash/. It does nothing unless -dash is set.
+func startDash() error {
+	if !*dashEnabled {
+		return nil
+	}
+	renditions, err := parseDashRenditions(*dashRenditions)
+	if err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp("", "dash-")
+	if err != nil {
+		return fmt.Errorf("create DASH directory: %w", err)
+	}
+
+	cmd := exec.Command(*ffmpegPath, dashArgs(dir, renditions)...)
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("create FFmpeg stdin pipe: %w", err)
+	}
+	stderr, err := pipeFFmpegLog(cmd, "dash")
+	if err != nil {
+		in.Close()
+		return err
+	}
+	err = cmd.Start()
+	stderr.Close()
+	if err != nil {
+		return fmt.Errorf("start DASH FFmpeg process: %w", err)
+	}
+	slog.Info("DASH stream started", "pid", cmd.Process.Pid, "dir", dir, "renditions", *dashRenditions)
+
+	dashFrames = make(chan []byte, 4)
+	go feedDash(cmd, in, dir)
+	http.Handle("/dash/", http.StripPrefix("/dash/", http.FileServer(http.Dir(dir))))
+	return nil
+}
+
+// feedDash writes frames from dashFrames to FFmpeg until it exits.
+func feedDash(cmd *exec.Cmd, in io.WriteCloser, dir string) {
+	defer logPanic("feedDash")
+
+	for frame := range dashFrames {
+		if _, err := in.Write(frame); err != nil {
+			slog.Error("failed to write frame to DASH FFmpeg", "error", err)
+			break
+		}
+	}
+	in.Close()
+	err := cmd.Wait()
+	os.RemoveAll(dir)
+	slog.Error("DASH FFmpeg exited", "error", err)
+}
+
+// writeDashFrame hands frame to the DASH FFmpeg process, dropping it if
+// FFmpeg is behind.
+func writeDashFrame(frame []byte) {
+	if dashFrames == nil {
+		return
+	}
+	select {
+	case dashFrames <- frame:
+	default:
+		slog.Debug("DASH encoder busy, dropping frame")
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"flag"
+	"hash/crc32"
+	"log/slog"
+	"time"
+)
+
+var dedupFrames = flag.Int("dedup-frames", 0, "stop sending frames to clients and the recording after this many identical frames in a row (0 disables)")
+
+// frameDeduplicator detects runs of identical camera frames. It is only used
+// by the frameBroadcaster goroutine.
+type frameDeduplicator struct {
+	lastSum  uint32
+	repeats  int // Frames identical to the previous one in the current run
+	skipped  int // Frames skipped since the last report
+	reported time.Time
+}
+
+var frameDedup frameDeduplicator
+
+// isDuplicateFrame reports whether the raw camera frame should be skipped
+// because it is the same as the previous -dedup-frames frames. The number of
+// skipped frames is logged once a minute.
+func isDuplicateFrame(frame []byte) bool {
+	if *dedupFrames <= 0 {
+		return false
+	}
+	d := &frameDedup
+
+	sum := crc32.ChecksumIEEE(frame)
+	if sum == d.lastSum {
+		d.repeats++
+	} else {
+		d.lastSum, d.repeats = sum, 0
+	}
+	skip := d.repeats >= *dedupFrames
+	if skip {
+		d.skipped++
+	}
+
+	if now := time.Now(); now.Sub(d.reported) >= time.Minute {
+		if d.skipped > 0 {
+			slog.Info("skipped duplicate frames", "count", d.skipped, "since", d.reported.Format(time.RFC3339))
+		}
+		d.skipped, d.reported = 0, now
+	}
+	return skip
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"math"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"syscall"
+
+	"github.com/vladimirvivien/go4vl/v4l2"
+)
+
+// videoDevice is a V4L2 device listed by /api/devices.
+type videoDevice struct {
+	Path         string   `json:"path"`
+	Name         string   `json:"name,omitempty"`
+	Driver       string   `json:"driver,omitempty"`
+	BusInfo      string   `json:"bus_info,omitempty"`
+	PixelFormats []string `json:"pixel_formats,omitempty"`
+	Error        string   `json:"error,omitempty"`
+}
+
+// fourCC returns the four character code of a V4L2 pixel format, e.g. "MJPG".
+func fourCC(f v4l2.FourCCType) string {
+	return string([]byte{byte(f), byte(f >> 8), byte(f >> 16), byte(f >> 24)})
+}
+
+// deviceError returns the system error behind err, such as "permission
+// denied", or err itself when there is none.
+func deviceError(err error) string {
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		return errno.Error()
+	}
+	return err.Error()
+}
+
+// openVideoDevice opens the V4L2 device at path read-only for querying.
+func openVideoDevice(path string) (uintptr, error) {
+	return v4l2.OpenDevice(path, syscall.O_RDONLY|syscall.O_NONBLOCK, 0)
+}
+
+// describeDevice returns the name and pixel formats of the device at path.
+func describeDevice(path string) videoDevice {
+	dev := videoDevice{Path: path}
+	fd, err := openVideoDevice(path)
+	if err != nil {
+		dev.Error = deviceError(err)
+		return dev
+	}
+	defer v4l2.CloseDevice(fd)
+
+	capability, err := v4l2.GetCapability(fd)
+	if err != nil {
+		dev.Error = deviceError(err)
+		return dev
+	}
+	dev.Name, dev.Driver, dev.BusInfo = capability.Card, capability.Driver, capability.BusInfo
+
+	formats, err := v4l2.GetAllFormatDescriptions(fd)
+	if err != nil {
+		slog.Debug("failed to list pixel formats", "device", path, "error", err)
+	}
+	for _, format := range formats {
+		dev.PixelFormats = append(dev.PixelFormats, fourCC(format.PixelFormat))
+	}
+	return dev
+}
+
+// devicesHandler lists the /dev/video* devices with their names and pixel
+// formats, or the error that prevented opening them.
+func devicesHandler(w http.ResponseWriter, r *http.Request) {
+	paths, err := filepath.Glob("/dev/video*")
+	if err != nil {
+		http.Error(w, "Unable to list devices", http.StatusInternalServerError)
+		return
+	}
+
+	devices := []videoDevice{}
+	for _, path := range paths {
+		devices = append(devices, describeDevice(path))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(devices); err != nil {
+		slog.Error("failed to encode devices", "error", err)
+	}
+}
+
+// devicePathPattern matches the device names accepted by /api/devices/{dev}/formats.
+var devicePathPattern = regexp.MustCompile(`^video[0-9]+$`)
+
+// deviceFormat is a pixel format of a device with the frame sizes it supports.
+type deviceFormat struct {
+	PixelFormat string            `json:"pixel_format"`
+	Description string            `json:"description"`
+	Compressed  bool              `json:"compressed"`
+	FrameSizes  []deviceFrameSize `json:"frame_sizes"`
+}
+
+// deviceFrameSize is a supported frame size. Stepwise and continuous sizes
+// are reported as a range with the frame rates of the largest size.
+type deviceFrameSize struct {
+	Type       string    `json:"type"` // discrete, stepwise or continuous
+	Width      uint32    `json:"width,omitempty"`
+	Height     uint32    `json:"height,omitempty"`
+	MinWidth   uint32    `json:"min_width,omitempty"`
+	MaxWidth   uint32    `json:"max_width,omitempty"`
+	StepWidth  uint32    `json:"step_width,omitempty"`
+	MinHeight  uint32    `json:"min_height,omitempty"`
+	MaxHeight  uint32    `json:"max_height,omitempty"`
+	StepHeight uint32    `json:"step_height,omitempty"`
+	FPS        []float64 `json:"fps,omitempty"`     // Discrete frame rates
+	MinFPS     float64   `json:"min_fps,omitempty"` // Range of frame rates when not discrete
+	MaxFPS     float64   `json:"max_fps,omitempty"`
+}
+
+var frameSizeTypes = map[v4l2.FrameSizeType]string{
+	v4l2.FrameSizeTypeDiscrete:   "discrete",
+	v4l2.FrameSizeTypeStepwise:   "stepwise",
+	v4l2.FrameSizeTypeContinuous: "continuous",
+}
+
+// fractFPS converts a frame interval to frames per second.
+func fractFPS(interval v4l2.Fract) float64 {
+	if interval.Numerator == 0 {
+		return 0
+	}
+	return math.Round(float64(interval.Denominator)/float64(interval.Numerator)*100) / 100
+}
+
+// addFrameRates fills in the frame rates the device supports for format at
+// width×height.
+func addFrameRates(fd uintptr, format v4l2.FourCCType, width, height uint32, size *deviceFrameSize) {
+	for index := uint32(0); ; index++ {
+		interval, err := v4l2.GetFormatFrameInterval(fd, index, format, width, height)
+		if err != nil {
+			return
+		}
+		if interval.Type != v4l2.FrameIntervalTypeDiscrete {
+			// The longest interval is the lowest frame rate
+			size.MinFPS, size.MaxFPS = fractFPS(interval.Interval.Max), fractFPS(interval.Interval.Min)
+			return
+		}
+		size.FPS = append(size.FPS, fractFPS(interval.Interval.Min))
+	}
+}
+
+// deviceFormats enumerates the pixel formats, frame sizes and frame rates of
+// the device open as fd.
+func deviceFormats(fd uintptr) ([]deviceFormat, error) {
+	descs, err := v4l2.GetAllFormatDescriptions(fd)
+	if len(descs) == 0 && err != nil {
+		return nil, err
+	}
+
+	formats := []deviceFormat{}
+	for _, desc := range descs {
+		format := deviceFormat{
+			PixelFormat: fourCC(desc.PixelFormat),
+			Description: desc.Description,
+			Compressed:  desc.Flags&v4l2.FmtDescFlagCompressed != 0,
+			FrameSizes:  []deviceFrameSize{},
+		}
+		sizes, err := v4l2.GetFormatFrameSizes(fd, desc.PixelFormat)
+		if err != nil {
+			slog.Debug("failed to list frame sizes", "format", format.PixelFormat, "error", err)
+		}
+		for _, s := range sizes {
+			size := deviceFrameSize{Type: frameSizeTypes[s.Type]}
+			if s.Type == v4l2.FrameSizeTypeDiscrete {
+				size.Width, size.Height = s.Size.MinWidth, s.Size.MinHeight
+			} else {
+				size.MinWidth, size.MaxWidth, size.StepWidth = s.Size.MinWidth, s.Size.MaxWidth, s.Size.StepWidth
+				size.MinHeight, size.MaxHeight, size.StepHeight = s.Size.MinHeight, s.Size.MaxHeight, s.Size.StepHeight
+			}
+			addFrameRates(fd, desc.PixelFormat, s.Size.MaxWidth, s.Size.MaxHeight, &size)
+			format.FrameSizes = append(format.FrameSizes, size)
+		}
+		formats = append(formats, format)
+	}
+	return formats, nil
+}
+
+// deviceFormatsHandler lists the pixel formats, frame sizes and frame rates
+// supported by /dev/{dev}.
+func deviceFormatsHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("dev")
+	if !devicePathPattern.MatchString(name) {
+		http.Error(w, "Device must be named like video0", http.StatusBadRequest)
+		return
+	}
+	path := "/dev/" + name
+
+	fd, err := openVideoDevice(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, path+": "+deviceError(err), http.StatusServiceUnavailable)
+		return
+	}
+	defer v4l2.CloseDevice(fd)
+
+	formats, err := deviceFormats(fd)
+	if err != nil {
+		http.Error(w, path+": "+deviceError(err), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(formats); err != nil {
+		slog.Error("failed to encode device formats", "device", path, "error", err)
+	}
+}
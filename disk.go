@@ -0,0 +1,78 @@
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var (
+	diskWarnGB = flag.Float64("disk-warn-gb", 0, "warn when free space in the video directory falls below this many GB (0 disables)")
+	diskOkGB   = flag.Float64("disk-ok-gb", 0, "free space in GB at which the disk counts as recovered after a -disk-warn-gb warning (0 uses -disk-warn-gb)")
+)
+
+// diskLow is set while free space is below -disk-warn-gb and has not yet
+// recovered to -disk-ok-gb.
+var diskLow atomic.Bool
+
+// onDiskLow, when set, is called after diskLow changes.
+var onDiskLow func(low bool)
+
+// freeDiskBytes returns the space available to unprivileged users at path.
+func freeDiskBytes(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return st.Bavail * uint64(st.Bsize), nil
+}
+
+// diskMonitor checks the free space in the recording directory every minute
+// and sends a webhook when it falls below -disk-warn-gb. The disk counts as
+// low until free space is back above -disk-ok-gb.
+func diskMonitor() {
+	defer logPanic("diskMonitor")
+
+	if *diskWarnGB <= 0 {
+		return
+	}
+	threshold := uint64(*diskWarnGB * 1e9)
+	recovered := max(threshold, uint64(*diskOkGB*1e9))
+	dir := recordingRoot()
+
+	for ; ; time.Sleep(time.Minute) {
+		free, err := freeDiskBytes(dir)
+		if err != nil {
+			slog.Error("failed to check free disk space", "dir", dir, "error", err)
+			continue
+		}
+
+		if diskLow.Load() {
+			if free >= recovered {
+				slog.Info("free disk space recovered", "dir", dir, "free_bytes", free)
+				setDiskLow(false)
+			}
+			continue
+		}
+		if free >= threshold {
+			continue
+		}
+		slog.Warn("free disk space low", "dir", dir, "free_bytes", free, "threshold_bytes", threshold)
+		setDiskLow(true)
+		notifyWebhook(map[string]any{
+			"event":           "disk_warning",
+			"timestamp":       time.Now().Format(time.RFC3339),
+			"free_bytes":      free,
+			"threshold_bytes": threshold,
+		})
+	}
+}
+
+func setDiskLow(low bool) {
+	diskLow.Store(low)
+	if onDiskLow != nil {
+		onDiskLow(low)
+	}
+}
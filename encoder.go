@@ -0,0 +1,134 @@
+//go:build recorder
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	videoEncoderName = flag.String("video-encoder", "", "FFmpeg video encoder for recording, e.g. libx264 or h264_v4l2m2m (empty picks the first working one)")
+	encoderPreset    = flag.String("encoder-preset", "", "value for FFmpeg's -preset option, for encoders that support it (empty omits it)")
+	encoderBitrate   = flag.String("encoder-bitrate", "1M", "recording bitrate passed to FFmpeg's -b:v option")
+)
+
+// encoderPreference lists the H.264 encoders to try, fastest first.
+var encoderPreference = []string{"h264_v4l2m2m", "h264_nvenc", "h264_videotoolbox", "libx264"}
+
+var (
+	encoderMutex    sync.RWMutex
+	selectedEncoder = "libx264" // Used when no encoder passes probeEncoders
+)
+
+// videoEncoder returns the encoder FFmpeg should use for recording.
+func videoEncoder() string {
+	encoderMutex.RLock()
+	defer encoderMutex.RUnlock()
+	return selectedEncoder
+}
+
+// useEncoder checks that FFmpeg provides encoder and selects it for recording.
+func useEncoder(encoder string) error {
+	if err := checkEncoder(encoder); err != nil {
+		return fmt.Errorf("-video-encoder: %w", err)
+	}
+
+	encoderMutex.Lock()
+	selectedEncoder = encoder
+	encoderMutex.Unlock()
+	slog.Info("selected video encoder", "encoder", encoder)
+	return nil
+}
+
+// encoderProbeTimeout bounds each encoder probe, so a hardware encoder that
+// never answers does not hold up the others.
+const encoderProbeTimeout = 5 * time.Second
+
+// probeEncoders encodes a single test frame with each preferred encoder and
+// caches the first one that works. It runs in the background while recording
+// starts with libx264, and restarts recording once it selects another encoder.
+func probeEncoders() {
+	defer logPanic("probeEncoders")
+
+	for _, encoder := range encoderPreference {
+		ctx, cancel := context.WithTimeout(context.Background(), encoderProbeTimeout)
+		cmd := exec.CommandContext(
+			ctx,
+			*ffmpegPath,
+			"-hide_banner",
+			"-loglevel", "error",
+			"-f", "lavfi",
+			"-i", "testsrc=size=320x240:rate=1",
+			"-frames:v", "1",
+			"-c:v", encoder,
+			"-f", "null",
+			"/dev/null",
+		)
+		err := cmd.Run()
+		cancel()
+		if err != nil {
+			slog.Debug("encoder probe failed", "encoder", encoder, "error", err)
+			continue
+		}
+
+		encoderMutex.Lock()
+		previous := selectedEncoder
+		selectedEncoder = encoder
+		encoderMutex.Unlock()
+		slog.Info("selected video encoder", "encoder", encoder)
+		if encoder != previous {
+			restartRecording()
+		}
+		return
+	}
+	slog.Warn("no encoder passed the probe, keeping default", "encoder", videoEncoder())
+}
+
+// degradedPreset replaces -encoder-preset for software encoders while the CPU
+// is saturated.
+const degradedPreset = "ultrafast"
+
+// softwareEncoder reports whether FFmpeg runs encoder on the CPU.
+func softwareEncoder(encoder string) bool {
+	return strings.HasPrefix(encoder, "lib")
+}
+
+// recordingPreset returns the -preset value for recording: -encoder-preset, or
+// degradedPreset for a software encoder while the CPU is saturated. Hardware
+// encoders do not load the CPU, so their preset is left alone.
+func recordingPreset() string {
+	if underLoad.Load() && softwareEncoder(videoEncoder()) {
+		return degradedPreset
+	}
+	return *encoderPreset
+}
+
+// recordingBitrate returns the -b:v value for recording: -encoder-bitrate, or
+// half of it while the CPU is saturated.
+func recordingBitrate() string {
+	if !underLoad.Load() {
+		return *encoderBitrate
+	}
+	return halveBitrate(*encoderBitrate)
+}
+
+// halveBitrate halves an FFmpeg bitrate such as "1M" or "800k". Values it does
+// not understand are returned unchanged.
+func halveBitrate(bitrate string) string {
+	multipliers := map[string]float64{"": 1, "k": 1e3, "K": 1e3, "M": 1e6, "G": 1e9}
+	number := strings.TrimRight(bitrate, "kKMG")
+	mult, ok := multipliers[bitrate[len(number):]]
+	v, err := strconv.ParseFloat(number, 64)
+	if !ok || err != nil || v <= 0 {
+		return bitrate
+	}
+	return strconv.Itoa(int(v*mult/2/1000)) + "k"
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+)
+
+// serverEvent is a single Server-Sent Event.
+type serverEvent struct {
+	name string
+	data []byte
+}
+
+type EventChan chan serverEvent
+
+var (
+	eventClients      = make(map[EventChan]struct{})
+	eventClientsMutex sync.Mutex
+)
+
+// publishEvent sends an event with data encoded as JSON to every /events client.
+// Clients that are not keeping up miss the event.
+func publishEvent(name string, data any) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		slog.Error("failed to encode event", "event", name, "error", err)
+		return
+	}
+
+	eventClientsMutex.Lock()
+	defer eventClientsMutex.Unlock()
+	for eventChan := range eventClients {
+		select {
+		case eventChan <- serverEvent{name: name, data: payload}:
+		default:
+		}
+	}
+}
+
+// eventsHandler streams published events to the client as Server-Sent Events.
+func eventsHandler(w http.ResponseWriter, req *http.Request) {
+	eventChan := make(EventChan, 16)
+	eventClientsMutex.Lock()
+	eventClients[eventChan] = struct{}{}
+	eventClientsMutex.Unlock()
+
+	defer func() {
+		eventClientsMutex.Lock()
+		delete(eventClients, eventChan)
+		eventClientsMutex.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	rc := http.NewResponseController(w)
+	if err := rc.Flush(); err != nil {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	for {
+		select {
+		case event := <-eventChan:
+			extendWriteDeadline(rc)
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.name, event.data); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
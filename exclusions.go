@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"image"
+	"image/draw"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+)
+
+// exclusionRect is a region of the frame, in pixels, where motion is ignored.
+type exclusionRect struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// motionExclusions are the regions masked out of frames before motion
+// detection.
+var motionExclusions atomic.Pointer[[]image.Rectangle]
+
+// maskExclusions blanks the motion exclusion zones in img, so they look the
+// same in every frame and never count as motion. Frames that are not YCbCr are
+// converted to RGBA first.
+func maskExclusions(img image.Image) image.Image {
+	zones := motionExclusions.Load()
+	if zones == nil || len(*zones) == 0 {
+		return img
+	}
+
+	if ycc, ok := img.(*image.YCbCr); ok {
+		for _, zone := range *zones {
+			r := zone.Intersect(ycc.Rect)
+			for y := r.Min.Y; y < r.Max.Y; y++ {
+				for x := r.Min.X; x < r.Max.X; x++ {
+					ycc.Y[ycc.YOffset(x, y)] = 0
+				}
+			}
+		}
+		return ycc
+	}
+
+	rgba := image.NewRGBA(img.Bounds())
+	draw.Draw(rgba, rgba.Rect, img, img.Bounds().Min, draw.Src)
+	for _, zone := range *zones {
+		draw.Draw(rgba, zone, image.Black, image.Point{}, draw.Src)
+	}
+	return rgba
+}
+
+// motionExclusionsHandler lists the motion exclusion zones on GET and replaces
+// them with the JSON array of rectangles in the body on POST.
+func motionExclusionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		var rects []exclusionRect
+		if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&rects); err != nil {
+			http.Error(w, "Invalid exclusion zones: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		zones := make([]image.Rectangle, 0, len(rects))
+		for _, rect := range rects {
+			if rect.Width <= 0 || rect.Height <= 0 || rect.X < 0 || rect.Y < 0 {
+				http.Error(w, "Exclusion zones need a non-negative position and a positive size", http.StatusBadRequest)
+				return
+			}
+			zones = append(zones, image.Rect(rect.X, rect.Y, rect.X+rect.Width, rect.Y+rect.Height))
+		}
+		motionExclusions.Store(&zones)
+		slog.Info("motion exclusion zones updated", "zones", len(zones))
+	}
+
+	rects := []exclusionRect{}
+	if zones := motionExclusions.Load(); zones != nil {
+		for _, z := range *zones {
+			rects = append(rects, exclusionRect{X: z.Min.X, Y: z.Min.Y, Width: z.Dx(), Height: z.Dy()})
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rects); err != nil {
+		slog.Error("failed to encode motion exclusion zones", "error", err)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"time"
+)
+
+// Exif tags written by ExifTimeProcessor.
+const (
+	exifIFDPointer         = 0x8769
+	gpsIFDPointer          = 0x8825
+	exifDateTimeOriginal   = 0x9003
+	exifOffsetTimeOriginal = 0x9011
+	exifSubSecTimeOriginal = 0x9291
+
+	gpsVersionID    = 0x0000
+	gpsLatitudeRef  = 0x0001
+	gpsLatitude     = 0x0002
+	gpsLongitudeRef = 0x0003
+	gpsLongitude    = 0x0004
+	gpsAltitudeRef  = 0x0005
+	gpsAltitude     = 0x0006
+
+	exifTypeByte     = 1
+	exifTypeASCII    = 2
+	exifTypeLong     = 4
+	exifTypeRational = 5
+)
+
+var (
+	jpegAPP0   = []byte{0xFF, 0xE0}
+	jpegAPP1   = []byte{0xFF, 0xE1}
+	exifHeader = []byte("Exif\x00\x00")
+)
+
+var errNotJPEG = errors.New("frame is not a JPEG image")
+
+// ExifTimeProcessor stamps frames with the time they were processed, in UTC, as
+// the Exif DateTimeOriginal, SubSecTimeOriginal and OffsetTimeOriginal tags,
+// and with the GPS position when one is known. The image data is left
+// untouched. Processors that re-encode the frame drop the Exif segment, so it
+// belongs at the end of -processor.
+type ExifTimeProcessor struct{}
+
+func (ExifTimeProcessor) Process(frame []byte) ([]byte, error) {
+	pos, _ := currentGPS()
+	return insertExif(frame, exifSegment(time.Now().UTC(), pos))
+}
+
+// exifSegment returns an APP1 segment holding t as the original date and time
+// and pos, if not nil, as the GPS position.
+func exifSegment(t time.Time, pos *gpsPosition) []byte {
+	exif := []ifdEntry{
+		asciiEntry(exifDateTimeOriginal, t.Format("2006:01:02 15:04:05")),
+		asciiEntry(exifOffsetTimeOriginal, "+00:00"),
+		asciiEntry(exifSubSecTimeOriginal, t.Format(".000")[1:]),
+	}
+	var gps []ifdEntry
+	if pos != nil {
+		gps = gpsEntries(pos)
+	}
+
+	// IFD0 only points to the Exif and GPS IFDs, which follow it
+	ifd0 := []ifdEntry{{tag: exifIFDPointer, typ: exifTypeLong, count: 1, data: make([]byte, 4)}}
+	if len(gps) > 0 {
+		ifd0 = append(ifd0, ifdEntry{tag: gpsIFDPointer, typ: exifTypeLong, count: 1, data: make([]byte, 4)})
+	}
+	const tiffHeader = 8
+	exifAt := tiffHeader + ifdSize(ifd0)
+	binary.BigEndian.PutUint32(ifd0[0].data, uint32(exifAt))
+	if len(gps) > 0 {
+		binary.BigEndian.PutUint32(ifd0[1].data, uint32(exifAt+ifdSize(exif)))
+	}
+
+	tiff := []byte("MM\x00\x2a")
+	tiff = binary.BigEndian.AppendUint32(tiff, tiffHeader)
+	tiff = appendIFD(tiff, ifd0)
+	tiff = appendIFD(tiff, exif)
+	if len(gps) > 0 {
+		tiff = appendIFD(tiff, gps)
+	}
+
+	segment := append([]byte{}, jpegAPP1...)
+	segment = binary.BigEndian.AppendUint16(segment, uint16(2+len(exifHeader)+len(tiff)))
+	segment = append(segment, exifHeader...)
+	return append(segment, tiff...)
+}
+
+// gpsEntries returns the GPS IFD entries for pos.
+func gpsEntries(pos *gpsPosition) []ifdEntry {
+	latRef, lonRef := "N", "E"
+	if pos.Lat < 0 {
+		latRef = "S"
+	}
+	if pos.Lon < 0 {
+		lonRef = "W"
+	}
+	entries := []ifdEntry{
+		{tag: gpsVersionID, typ: exifTypeByte, count: 4, data: []byte{2, 3, 0, 0}},
+		asciiEntry(gpsLatitudeRef, latRef),
+		rationalEntry(gpsLatitude, degreesMinutesSeconds(pos.Lat)...),
+		asciiEntry(gpsLongitudeRef, lonRef),
+		rationalEntry(gpsLongitude, degreesMinutesSeconds(pos.Lon)...),
+	}
+	if !math.IsNaN(pos.Alt) {
+		var below byte
+		if pos.Alt < 0 {
+			below = 1
+		}
+		entries = append(entries,
+			ifdEntry{tag: gpsAltitudeRef, typ: exifTypeByte, count: 1, data: []byte{below}},
+			rationalEntry(gpsAltitude, [2]uint32{uint32(math.Round(math.Abs(pos.Alt) * 100)), 100}),
+		)
+	}
+	return entries
+}
+
+// degreesMinutesSeconds splits the absolute value of a coordinate in degrees
+// into Exif rationals, with seconds to a thousandth. Rounding is done before
+// splitting, so 59.9999″ carries into the minutes instead of becoming 60″.
+func degreesMinutesSeconds(deg float64) [][2]uint32 {
+	ms := uint32(math.Round(math.Abs(deg) * 3600 * 1000)) // Thousandths of a second of arc
+	return [][2]uint32{{ms / 3600000, 1}, {ms / 60000 % 60, 1}, {ms % 60000, 1000}}
+}
+
+// ifdEntry is a TIFF image file directory entry with its big-endian value.
+type ifdEntry struct {
+	tag, typ uint16
+	count    uint32
+	data     []byte
+}
+
+func asciiEntry(tag uint16, s string) ifdEntry {
+	return ifdEntry{tag: tag, typ: exifTypeASCII, count: uint32(len(s) + 1), data: append([]byte(s), 0)}
+}
+
+func rationalEntry(tag uint16, values ...[2]uint32) ifdEntry {
+	var data []byte
+	for _, v := range values {
+		data = binary.BigEndian.AppendUint32(data, v[0])
+		data = binary.BigEndian.AppendUint32(data, v[1])
+	}
+	return ifdEntry{tag: tag, typ: exifTypeRational, count: uint32(len(values)), data: data}
+}
+
+// ifdSize returns the size of an IFD with entries, including the values
+// stored after it.
+func ifdSize(entries []ifdEntry) int {
+	n := 2 + 12*len(entries) + 4
+	for _, e := range entries {
+		if len(e.data) > 4 {
+			n += len(e.data) + len(e.data)%2
+		}
+	}
+	return n
+}
+
+// appendIFD appends an IFD with entries, which must be sorted by tag, and no
+// next IFD to the TIFF data b. Values over four bytes are stored after the IFD.
+func appendIFD(b []byte, entries []ifdEntry) []byte {
+	valuesAt := len(b) + 2 + 12*len(entries) + 4
+	var values []byte
+
+	b = binary.BigEndian.AppendUint16(b, uint16(len(entries)))
+	for _, e := range entries {
+		b = binary.BigEndian.AppendUint16(b, e.tag)
+		b = binary.BigEndian.AppendUint16(b, e.typ)
+		b = binary.BigEndian.AppendUint32(b, e.count)
+		if len(e.data) <= 4 {
+			b = append(b, e.data...)
+			b = append(b, make([]byte, 4-len(e.data))...)
+			continue
+		}
+		b = binary.BigEndian.AppendUint32(b, uint32(valuesAt+len(values)))
+		values = append(values, e.data...)
+		if len(e.data)%2 != 0 {
+			values = append(values, 0) // Offsets are word aligned
+		}
+	}
+	b = binary.BigEndian.AppendUint32(b, 0)
+	return append(b, values...)
+}
+
+// insertExif returns frame with the APP1 segment exif after the SOI marker
+// and any JFIF APP0 segment, replacing an Exif segment already there.
+func insertExif(frame, exif []byte) ([]byte, error) {
+	if !bytes.HasPrefix(frame, jpegSOI) {
+		return nil, errNotJPEG
+	}
+	at := len(jpegSOI)
+	if bytes.HasPrefix(frame[at:], jpegAPP0) {
+		if at = skipSegment(frame, at); at > len(frame) {
+			return nil, errNotJPEG
+		}
+	}
+	rest := at
+	if bytes.HasPrefix(frame[at:], jpegAPP1) && len(frame) >= at+4+len(exifHeader) && bytes.Equal(frame[at+4:at+4+len(exifHeader)], exifHeader) {
+		if rest = skipSegment(frame, at); rest > len(frame) {
+			return nil, errNotJPEG
+		}
+	}
+
+	out := make([]byte, 0, len(frame)+len(exif))
+	out = append(out, frame[:at]...)
+	out = append(out, exif...)
+	return append(out, frame[rest:]...), nil
+}
+
+// skipSegment returns the offset after the marker segment at offset at, or
+// past the end of frame if the segment is truncated.
+func skipSegment(frame []byte, at int) int {
+	if at+4 > len(frame) {
+		return len(frame) + 1
+	}
+	return at + 2 + int(binary.BigEndian.Uint16(frame[at+2:]))
+}
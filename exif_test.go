@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"math"
+	"slices"
+	"testing"
+	"time"
+)
+
+// exifTypeSizes are the sizes of the Exif value types exifSegment writes.
+var exifTypeSizes = map[uint16]int{
+	exifTypeByte:     1,
+	exifTypeASCII:    1,
+	exifTypeLong:     4,
+	exifTypeRational: 8,
+}
+
+// readIFD returns the values of the IFD at offset in the big-endian TIFF data,
+// by tag, checking that every value lies inside tiff.
+func readIFD(t *testing.T, tiff []byte, offset uint32) map[uint16][]byte {
+	t.Helper()
+	if int(offset)+2 > len(tiff) {
+		t.Fatalf("IFD at %d is past the end of %d bytes of TIFF data", offset, len(tiff))
+	}
+	n := int(binary.BigEndian.Uint16(tiff[offset:]))
+	if int(offset)+2+12*n+4 > len(tiff) {
+		t.Fatalf("IFD at %d with %d entries is truncated", offset, n)
+	}
+	values := make(map[uint16][]byte)
+	prev := -1
+	for i := range n {
+		e := tiff[int(offset)+2+12*i:]
+		tag, typ, count := binary.BigEndian.Uint16(e), binary.BigEndian.Uint16(e[2:]), binary.BigEndian.Uint32(e[4:])
+		if int(tag) <= prev {
+			t.Errorf("IFD at %d: tag %#04x follows %#04x, tags must be sorted", offset, tag, prev)
+		}
+		prev = int(tag)
+		size, ok := exifTypeSizes[typ]
+		if !ok {
+			t.Fatalf("tag %#04x has unexpected type %d", tag, typ)
+		}
+		size *= int(count)
+		if size <= 4 {
+			values[tag] = e[8 : 8+size]
+			continue
+		}
+		at := binary.BigEndian.Uint32(e[8:])
+		if at%2 != 0 || int(at)+size > len(tiff) {
+			t.Fatalf("tag %#04x: value of %d bytes at %d is unaligned or outside the TIFF data", tag, size, at)
+		}
+		values[tag] = tiff[at : int(at)+size]
+	}
+	return values
+}
+
+// readExif parses the APP1 segment at the start of segment and returns the
+// values of its Exif and GPS IFDs. gps is nil when there is no GPS IFD.
+func readExif(t *testing.T, segment []byte) (exif, gps map[uint16][]byte) {
+	t.Helper()
+	if !bytes.HasPrefix(segment, jpegAPP1) {
+		t.Fatalf("segment starts with % x, want APP1", segment[:2])
+	}
+	length := int(binary.BigEndian.Uint16(segment[2:]))
+	if 2+length > len(segment) {
+		t.Fatalf("APP1 length %d is longer than the %d bytes left", length, len(segment)-2)
+	}
+	body := segment[4 : 2+length]
+	tiff, ok := bytes.CutPrefix(body, exifHeader)
+	if !ok {
+		t.Fatalf("APP1 does not start with the Exif header")
+	}
+	if !bytes.HasPrefix(tiff, []byte("MM\x00\x2a")) {
+		t.Fatalf("TIFF header % x, want big-endian", tiff[:4])
+	}
+
+	ifd0 := readIFD(t, tiff, binary.BigEndian.Uint32(tiff[4:]))
+	exifAt, ok := ifd0[exifIFDPointer]
+	if !ok {
+		t.Fatal("IFD0 has no Exif IFD pointer")
+	}
+	exif = readIFD(t, tiff, binary.BigEndian.Uint32(exifAt))
+	if gpsAt, ok := ifd0[gpsIFDPointer]; ok {
+		gps = readIFD(t, tiff, binary.BigEndian.Uint32(gpsAt))
+	}
+	return exif, gps
+}
+
+// rationals decodes a value of Exif rationals.
+func rationals(b []byte) [][2]uint32 {
+	var r [][2]uint32
+	for ; len(b) >= 8; b = b[8:] {
+		r = append(r, [2]uint32{binary.BigEndian.Uint32(b), binary.BigEndian.Uint32(b[4:])})
+	}
+	return r
+}
+
+func TestExifSegment(t *testing.T) {
+	when := time.Date(2026, 10, 15, 14, 3, 9, 27_000_000, time.UTC)
+	tests := []struct {
+		name    string
+		pos     *gpsPosition
+		wantGPS map[uint16][]byte
+	}{
+		{
+			name: "no position",
+		},
+		{
+			name: "north east without altitude",
+			pos:  &gpsPosition{Lat: 48.1173, Lon: 11.516666666666667, Alt: math.NaN()},
+			wantGPS: map[uint16][]byte{
+				gpsVersionID:    {2, 3, 0, 0},
+				gpsLatitudeRef:  []byte("N\x00"),
+				gpsLatitude:     rationalEntry(0, [2]uint32{48, 1}, [2]uint32{7, 1}, [2]uint32{2280, 1000}).data,
+				gpsLongitudeRef: []byte("E\x00"),
+				gpsLongitude:    rationalEntry(0, [2]uint32{11, 1}, [2]uint32{31, 1}, [2]uint32{0, 1000}).data,
+			},
+		},
+		{
+			name: "south west below sea level",
+			pos:  &gpsPosition{Lat: -33.8568, Lon: -70.5, Alt: -12.345},
+			wantGPS: map[uint16][]byte{
+				gpsVersionID:    {2, 3, 0, 0},
+				gpsLatitudeRef:  []byte("S\x00"),
+				gpsLatitude:     rationalEntry(0, [2]uint32{33, 1}, [2]uint32{51, 1}, [2]uint32{24480, 1000}).data,
+				gpsLongitudeRef: []byte("W\x00"),
+				gpsLongitude:    rationalEntry(0, [2]uint32{70, 1}, [2]uint32{30, 1}, [2]uint32{0, 1000}).data,
+				gpsAltitudeRef:  {1},
+				gpsAltitude:     rationalEntry(0, [2]uint32{1235, 100}).data,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exif, gps := readExif(t, exifSegment(when, tt.pos))
+
+			wantExif := map[uint16]string{
+				exifDateTimeOriginal:   "2026:10:15 14:03:09\x00",
+				exifOffsetTimeOriginal: "+00:00\x00",
+				exifSubSecTimeOriginal: "027\x00",
+			}
+			if len(exif) != len(wantExif) {
+				t.Errorf("Exif IFD has %d entries, want %d", len(exif), len(wantExif))
+			}
+			for tag, want := range wantExif {
+				if got := string(exif[tag]); got != want {
+					t.Errorf("Exif tag %#04x = %q, want %q", tag, got, want)
+				}
+			}
+
+			if tt.wantGPS == nil {
+				if gps != nil {
+					t.Errorf("GPS IFD written without a position: %v", gps)
+				}
+				return
+			}
+			if len(gps) != len(tt.wantGPS) {
+				t.Errorf("GPS IFD has %d entries, want %d", len(gps), len(tt.wantGPS))
+			}
+			for tag, want := range tt.wantGPS {
+				got := gps[tag]
+				if !bytes.Equal(got, want) {
+					t.Errorf("GPS tag %#04x = % x (%v), want % x (%v)", tag, got, rationals(got), want, rationals(want))
+				}
+			}
+		})
+	}
+}
+
+// jfifAPP0 is a JFIF APP0 segment, as written by most cameras.
+var jfifAPP0 = []byte{0xFF, 0xE0, 0x00, 0x10, 'J', 'F', 'I', 'F', 0x00, 0x01, 0x01, 0x00, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00}
+
+// exifSegments returns the Exif APP1 segments among the marker segments
+// before the image data of frame.
+func exifSegments(t *testing.T, frame []byte) [][]byte {
+	t.Helper()
+	var segments [][]byte
+	for at := len(jpegSOI); at+4 <= len(frame) && frame[at] == 0xFF; {
+		marker := frame[at+1]
+		if marker == 0xDA { // Start of scan
+			break
+		}
+		end := skipSegment(frame, at)
+		if end > len(frame) {
+			t.Fatalf("segment %#02x at %d is truncated", marker, at)
+		}
+		if marker == 0xE1 && bytes.HasPrefix(frame[at+4:], exifHeader) {
+			segments = append(segments, frame[at:end])
+		}
+		at = end
+	}
+	return segments
+}
+
+func TestInsertExif(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 16, 16))
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	plain := buf.Bytes() // image/jpeg writes no APP0
+	withAPP0 := slices.Concat(jpegSOI, jfifAPP0, plain[len(jpegSOI):])
+	earlier := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	withExif, err := insertExif(withAPP0, exifSegment(earlier, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	when := time.Date(2026, 10, 15, 14, 3, 9, 0, time.UTC)
+	tests := []struct {
+		name     string
+		frame    []byte
+		wantAPP0 bool
+	}{
+		{"without APP0", plain, false},
+		{"with APP0", withAPP0, true},
+		{"with Exif", withExif, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := insertExif(tt.frame, exifSegment(when, nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hasAPP0 := bytes.HasPrefix(out[len(jpegSOI):], jfifAPP0); hasAPP0 != tt.wantAPP0 {
+				t.Errorf("APP0 right after SOI = %v, want %v", hasAPP0, tt.wantAPP0)
+			}
+			segments := exifSegments(t, out)
+			if len(segments) != 1 {
+				t.Fatalf("got %d Exif segments, want 1", len(segments))
+			}
+			exif, _ := readExif(t, segments[0])
+			if got, want := string(exif[exifDateTimeOriginal]), "2026:10:15 14:03:09\x00"; got != want {
+				t.Errorf("DateTimeOriginal = %q, want %q", got, want)
+			}
+			if _, err := jpeg.Decode(bytes.NewReader(out)); err != nil {
+				t.Errorf("frame with Exif does not decode: %v", err)
+			}
+		})
+	}
+
+	for _, frame := range [][]byte{nil, []byte("not a jpeg"), slices.Concat(jpegSOI, jpegAPP0)} {
+		if _, err := insertExif(frame, exifSegment(when, nil)); err != errNotJPEG {
+			t.Errorf("insertExif(% x) error = %v, want errNotJPEG", frame, err)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+//go:build recorder
+
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"time"
+
+	"github.com/vladimirvivien/go4vl/device"
+)
+
+var (
+	failoverDevice  = flag.String("failover-device", "", "camera device recorded while the primary delivers no frames, e.g. /dev/video2")
+	failoverTimeout = flag.Int("failover-timeout-seconds", 10, "seconds without frames from the primary camera before switching to -failover-device")
+)
+
+// primaryStalled reports whether the primary camera has gone timeout without a
+// frame. The stall clock starts at started, so a camera that has not delivered
+// its first frame yet is given timeout from then.
+func primaryStalled(started time.Time, timeout time.Duration) bool {
+	last := lastFrameTime()
+	if last.Before(started) {
+		last = started
+	}
+	return time.Since(last) > timeout
+}
+
+// failoverMonitor switches recording to -failover-device when the primary
+// camera stops producing frames and back once it recovers.
+func failoverMonitor() {
+	defer logPanic("failoverMonitor")
+
+	if *failoverDevice == "" {
+		return
+	}
+	timeout := time.Duration(*failoverTimeout) * time.Second
+	started := time.Now()
+
+	var secondary *device.Device
+	for ; ; time.Sleep(time.Second) {
+		stalled := primaryStalled(started, timeout)
+		switch {
+		case stalled && secondary == nil:
+			var err error
+			secondary, err = openDevice(*failoverDevice)
+			if err != nil {
+				slog.Error("failed to open failover camera", "device", *failoverDevice, "error", err)
+				secondary = nil
+				continue
+			}
+			slog.Warn("switching to failover camera", "device", *failoverDevice, "primary", devName)
+			failoverName.Store(*failoverDevice)
+			go recordFailoverFrames(secondary)
+		case !stalled && secondary != nil:
+			secondary.Close()
+			secondary = nil
+			failoverName.Store("")
+			slog.Info("primary camera restored", "device", devName)
+		}
+	}
+}
+
+// recordFailoverFrames records frames from camera until it is closed.
+func recordFailoverFrames(camera *device.Device) {
+	defer logPanic("recordFailoverFrames")
+
+	for frame := range camera.GetOutput() {
+		if len(frame) == 0 {
+			continue
+		}
+		frame, err := frameToJPEG(camera, frame)
+		if err != nil {
+			continue
+		}
+		if err := writeRecordingFrame(applyProcessors(frame)); err != nil {
+			slog.Error("failed to write failover frame to FFmpeg", "error", err)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+//go:build recorder
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPrimaryStalled(t *testing.T) {
+	saved := latestFrameAt.Load()
+	t.Cleanup(func() { latestFrameAt.Store(saved) })
+
+	now := time.Now()
+	tests := []struct {
+		name    string
+		frameAt time.Time // Zero if no frame has arrived
+		started time.Time
+		want    bool
+	}{
+		{"boot before first frame", time.Time{}, now, false},
+		{"no frame since boot", time.Time{}, now.Add(-20 * time.Second), true},
+		{"recent frame", now.Add(-time.Second), now.Add(-time.Minute), false},
+		{"frames stopped", now.Add(-20 * time.Second), now.Add(-time.Minute), true},
+	}
+	for _, tt := range tests {
+		at := int64(0)
+		if !tt.frameAt.IsZero() {
+			at = tt.frameAt.UnixNano()
+		}
+		latestFrameAt.Store(at)
+		if got := primaryStalled(tt.started, 10*time.Second); got != tt.want {
+			t.Errorf("%s: primaryStalled = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
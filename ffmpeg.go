@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+var ffmpegPath = flag.String("ffmpeg-path", "ffmpeg", "FFmpeg binary used for recording and playback")
+
+// checkEncoder returns an error unless encoder appears in the output of
+// ffmpeg -encoders.
+func checkEncoder(encoder string) error {
+	out, err := exec.Command(*ffmpegPath, "-hide_banner", "-encoders").Output()
+	if err != nil {
+		return fmt.Errorf("list FFmpeg encoders: %w", err)
+	}
+
+	// Encoder lines look like " V....D libx264  libx264 H.264 / AVC ..."
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[1] == encoder {
+			return nil
+		}
+	}
+	return fmt.Errorf("FFmpeg has no encoder %q", encoder)
+}
+
+// ffmpegLogLevels maps the level prefixes FFmpeg prints with -loglevel level+...
+// to slog levels.
+var ffmpegLogLevels = map[string]slog.Level{
+	"panic":   slog.LevelError,
+	"fatal":   slog.LevelError,
+	"error":   slog.LevelError,
+	"warning": slog.LevelWarn,
+	"info":    slog.LevelInfo,
+	"verbose": slog.LevelDebug,
+	"debug":   slog.LevelDebug,
+	"trace":   slog.LevelDebug,
+}
+
+// parseFFmpegLogLine splits an FFmpeg log line such as
+// "[mjpeg @ 0x5581] [warning] unable to decode APP fields" into its level and
+// the line without the level prefix. Lines without one are logged at info.
+func parseFFmpegLogLine(line string) (slog.Level, string) {
+	rest := line
+	for strings.HasPrefix(rest, "[") {
+		end := strings.Index(rest, "] ")
+		if end < 0 {
+			break
+		}
+		if level, ok := ffmpegLogLevels[rest[1:end]]; ok {
+			return level, line[:len(line)-len(rest)] + rest[end+2:]
+		}
+		rest = rest[end+2:]
+	}
+	return slog.LevelInfo, line
+}
+
+// logFFmpegOutput logs each line FFmpeg writes to r at its own level until r
+// is closed.
+func logFFmpegOutput(r io.ReadCloser, process string) {
+	defer logPanic("logFFmpegOutput")
+	defer r.Close()
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		level, msg := parseFFmpegLogLine(scanner.Text())
+		if msg != "" {
+			slog.Log(context.Background(), level, msg, "process", process)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		slog.Error("failed to read FFmpeg output", "process", process, "error", err)
+	}
+}
+
+// pipeFFmpegLog sends cmd's stderr through logFFmpegOutput. The returned write
+// end of the pipe must be closed once cmd has been started, so the logger sees
+// EOF when FFmpeg exits.
+func pipeFFmpegLog(cmd *exec.Cmd, process string) (*os.File, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("create FFmpeg stderr pipe: %w", err)
+	}
+	cmd.Stderr = w
+	go logFFmpegOutput(r, process)
+	return w, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"flag"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+var expectedFPS = flag.Float64("expected-fps", 15, "frame rate the camera is expected to deliver; health is degraded below half of it (or of -fps-cap, if lower)")
+
+// fpsSmoothing is the weight of each new frame interval in the frame rate average.
+const fpsSmoothing = 0.1
+
+// The camera is degraded once the frame rate has stayed below
+// degradedFPSRatio of the target for degradedAfter.
+const (
+	degradedFPSRatio = 0.5
+	degradedAfter    = 5 * time.Second
+)
+
+var (
+	measuredFPS atomic.Uint64 // math.Float64bits of the average frame rate
+	fpsDegraded atomic.Bool
+)
+
+// measureFrame adds a frame received now to the frame rate average, measuring
+// from the arrival of the previous frame. It is only called by
+// broadcastCamera, before storeLatestFrame records the new frame's arrival.
+// Frames that -dedup-frames keeps from clients count too, as the camera did
+// deliver them.
+func measureFrame() {
+	prev := lastFrameTime()
+	elapsed := time.Since(prev)
+	if prev.IsZero() || elapsed <= 0 {
+		return
+	}
+	instant := float64(time.Second) / float64(elapsed)
+	avg := math.Float64frombits(measuredFPS.Load())
+	if avg == 0 {
+		avg = instant
+	} else {
+		avg += fpsSmoothing * (instant - avg)
+	}
+	measuredFPS.Store(math.Float64bits(avg))
+}
+
+// currentFPS returns the average frame rate. When frames stop arriving it
+// falls off as if the next frame were arriving now.
+func currentFPS() float64 {
+	avg := math.Float64frombits(measuredFPS.Load())
+	last := lastFrameTime()
+	if last.IsZero() {
+		return 0
+	}
+	if since := time.Since(last); since > time.Second {
+		avg = min(avg, float64(time.Second)/float64(since))
+	}
+	return math.Round(avg*10) / 10
+}
+
+// targetFPS returns the frame rate the camera should be delivering.
+func targetFPS() float64 {
+	if *fpsCap > 0 && float64(*fpsCap) < *expectedFPS {
+		return float64(*fpsCap)
+	}
+	return *expectedFPS
+}
+
+// fpsMonitor sets fpsDegraded while the frame rate has been below half the
+// target for more than degradedAfter.
+func fpsMonitor() {
+	defer logPanic("fpsMonitor")
+
+	var lowSince time.Time
+	for range time.Tick(time.Second) {
+		if currentFPS() >= targetFPS()*degradedFPSRatio {
+			lowSince = time.Time{}
+			fpsDegraded.Store(false)
+			continue
+		}
+		if lowSince.IsZero() {
+			lowSince = time.Now()
+		}
+		fpsDegraded.Store(time.Since(lowSince) > degradedAfter)
+	}
+}
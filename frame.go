@@ -0,0 +1,15 @@
+package main
+
+import "bytes"
+
+var (
+	jpegSOI = []byte{0xFF, 0xD8}
+	jpegEOI = []byte{0xFF, 0xD9}
+)
+
+// validJPEG reports whether frame starts with a JPEG start-of-image marker and
+// ends with an end-of-image marker. V4L2 MJPEG devices occasionally deliver
+// partial frames that fail this check.
+func validJPEG(frame []byte) bool {
+	return bytes.HasPrefix(frame, jpegSOI) && bytes.HasSuffix(frame, jpegEOI)
+}
@@ -0,0 +1,75 @@
+//go:build recorder
+
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"time"
+
+	"github.com/warthog618/gpiod"
+)
+
+var gpioPin = flag.Int("gpio-pin", -1, "BCM number of a GPIO pin whose rising edge starts recording and falling edge stops it (-1 disables)")
+
+const gpioDebounce = 200 * time.Millisecond
+
+// gpioLine is the requested -gpio-pin, kept so it is not released.
+var gpioLine *gpiod.Line
+
+// startGPIO watches -gpio-pin and starts or stops recording on each debounced
+// edge. Recording is brought in line with the pin's current level first.
+func startGPIO() error {
+	if *gpioPin < 0 {
+		return nil
+	}
+	line, err := gpiod.RequestLine(*gpioChip, *gpioPin,
+		gpiod.AsInput,
+		gpiod.WithBothEdges,
+		gpiod.WithDebounce(gpioDebounce),
+		gpiod.WithEventHandler(handleGPIOEvent))
+	if err != nil {
+		return err
+	}
+	gpioLine = line
+
+	level, err := line.Value()
+	if err != nil {
+		return err
+	}
+	slog.Info("watching GPIO pin for recording control", "chip", *gpioChip, "pin", *gpioPin, "level", level)
+	setRecordingFromGPIO(level == 1)
+	return nil
+}
+
+// handleGPIOEvent is called by gpiod for each edge on -gpio-pin.
+func handleGPIOEvent(event gpiod.LineEvent) {
+	defer logPanic("gpio")
+
+	high := event.Type == gpiod.LineEventRisingEdge
+	edge := "falling"
+	if high {
+		edge = "rising"
+	}
+	slog.Info("GPIO pin changed", "pin", *gpioPin, "edge", edge)
+	publishEvent("gpio", map[string]any{
+		"pin":       *gpioPin,
+		"edge":      edge,
+		"timestamp": time.Now().Format(time.RFC3339),
+	})
+	setRecordingFromGPIO(high)
+}
+
+// setRecordingFromGPIO starts recording when the pin is high and stops it when
+// low.
+func setRecordingFromGPIO(high bool) {
+	if high {
+		if err := startRecording(); err != nil {
+			slog.Error("failed to start recording from GPIO", "error", err)
+		}
+		return
+	}
+	if err := stopRecording(); err != nil {
+		slog.Error("failed to stop recording from GPIO", "error", err)
+	}
+}
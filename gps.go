@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	gpsLat    = flag.Float64("gps-lat", 0, "static latitude in degrees written to the Exif of every frame, negative in the south")
+	gpsLon    = flag.Float64("gps-lon", 0, "static longitude in degrees written to the Exif of every frame, negative in the west")
+	gpsAlt    = flag.Float64("gps-alt", math.NaN(), "static altitude in meters written with -gps-lat and -gps-lon (NaN omits it)")
+	gpsSerial = flag.String("gps-serial", "", "serial device of an NMEA GPS receiver, e.g. /dev/ttyAMA0, whose position is written to the Exif of every frame")
+	gpsBaud   = flag.Int("gps-baud", 9600, "baud rate of -gps-serial")
+)
+
+// gpsRetryInterval is how long to wait before reopening -gps-serial after it
+// failed.
+const gpsRetryInterval = 5 * time.Second
+
+// gpsPosition is a position in degrees and meters. Alt is NaN when unknown.
+type gpsPosition struct {
+	Lat, Lon, Alt float64
+}
+
+// The current position as float64 bits, valid while gpsFix is set.
+var (
+	gpsLatBits atomic.Uint64
+	gpsLonBits atomic.Uint64
+	gpsAltBits atomic.Uint64
+	gpsFix     atomic.Bool
+)
+
+var baudRates = map[int]uint32{
+	4800:   unix.B4800,
+	9600:   unix.B9600,
+	19200:  unix.B19200,
+	38400:  unix.B38400,
+	57600:  unix.B57600,
+	115200: unix.B115200,
+}
+
+// gpsEnabled reports whether frames are to be tagged with a position.
+func gpsEnabled() bool {
+	return *gpsSerial != "" || *gpsLat != 0 || *gpsLon != 0
+}
+
+// currentGPS returns the current position, if there is one.
+func currentGPS() (*gpsPosition, bool) {
+	if !gpsFix.Load() {
+		return nil, false
+	}
+	return &gpsPosition{
+		Lat: math.Float64frombits(gpsLatBits.Load()),
+		Lon: math.Float64frombits(gpsLonBits.Load()),
+		Alt: math.Float64frombits(gpsAltBits.Load()),
+	}, true
+}
+
+// setGPS publishes a new latitude and longitude.
+func setGPS(lat, lon float64) {
+	gpsLatBits.Store(math.Float64bits(lat))
+	gpsLonBits.Store(math.Float64bits(lon))
+	gpsFix.Store(true)
+}
+
+// startGPS sets the static -gps-lat and -gps-lon position, or starts reading
+// -gps-serial.
+func startGPS() error {
+	gpsAltBits.Store(math.Float64bits(*gpsAlt))
+	if *gpsSerial == "" {
+		if *gpsLat != 0 || *gpsLon != 0 {
+			if math.Abs(*gpsLat) > 90 || math.Abs(*gpsLon) > 180 {
+				return fmt.Errorf("position %v,%v is out of range", *gpsLat, *gpsLon)
+			}
+			setGPS(*gpsLat, *gpsLon)
+		}
+		return nil
+	}
+	if _, ok := baudRates[*gpsBaud]; !ok {
+		return fmt.Errorf("unsupported baud rate %d", *gpsBaud)
+	}
+	go gpsReader()
+	return nil
+}
+
+// gpsReader reads NMEA sentences from -gps-serial and updates the position,
+// reopening the device after errors.
+func gpsReader() {
+	defer logPanic("gpsReader")
+
+	for {
+		if err := readNMEA(*gpsSerial); err != nil {
+			slog.Error("failed to read GPS", "device", *gpsSerial, "retry_in", gpsRetryInterval, "error", err)
+		}
+		gpsFix.Store(false)
+		time.Sleep(gpsRetryInterval)
+	}
+}
+
+// readNMEA reads sentences from the serial device path until it fails.
+func readNMEA(path string) error {
+	f, err := os.OpenFile(path, os.O_RDONLY|unix.O_NOCTTY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := configureSerial(f, baudRates[*gpsBaud]); err != nil {
+		slog.Debug("GPS device is not configurable as a serial port", "device", path, "error", err)
+	}
+	slog.Info("reading GPS", "device", path, "baud", *gpsBaud)
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		handleNMEA(strings.TrimSpace(scanner.Text()))
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return errors.New("GPS device closed")
+}
+
+// configureSerial puts the terminal f in raw mode at speed.
+func configureSerial(f *os.File, speed uint32) error {
+	fd := int(f.Fd())
+	t, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return err
+	}
+	t.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	t.Oflag &^= unix.OPOST
+	t.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	t.Cflag &^= unix.CSIZE | unix.PARENB | unix.CBAUD
+	t.Cflag |= unix.CS8 | unix.CLOCAL | unix.CREAD | speed
+	t.Ispeed, t.Ospeed = speed, speed
+	t.Cc[unix.VMIN], t.Cc[unix.VTIME] = 1, 0
+	return unix.IoctlSetTermios(fd, unix.TCSETS, t)
+}
+
+// handleNMEA updates the position from an RMC sentence, such as
+// "$GPRMC,123519,A,4807.038,N,01131.000,E,022.4,084.4,230394,003.1,W*6A", and
+// the altitude from a GGA sentence. Other sentences are ignored.
+func handleNMEA(sentence string) {
+	fields, err := parseNMEA(sentence)
+	if err != nil {
+		slog.Debug("invalid NMEA sentence", "sentence", sentence, "error", err)
+		return
+	}
+	switch {
+	case strings.HasSuffix(fields[0], "RMC") && len(fields) >= 7:
+		if fields[2] != "A" {
+			gpsFix.Store(false) // Receiver has no fix
+			return
+		}
+		lat, err1 := nmeaCoordinate(fields[3], fields[4])
+		lon, err2 := nmeaCoordinate(fields[5], fields[6])
+		if err := errors.Join(err1, err2); err != nil {
+			slog.Debug("invalid NMEA position", "sentence", sentence, "error", err)
+			return
+		}
+		if !gpsFix.Load() {
+			slog.Info("GPS fix acquired", "lat", lat, "lon", lon)
+		}
+		setGPS(lat, lon)
+	case strings.HasSuffix(fields[0], "GGA") && len(fields) >= 10:
+		if alt, err := strconv.ParseFloat(fields[9], 64); err == nil {
+			gpsAltBits.Store(math.Float64bits(alt))
+		}
+	}
+}
+
+// parseNMEA checks the checksum of an NMEA sentence and returns its fields,
+// starting with the talker and sentence type, e.g. "GPRMC".
+func parseNMEA(sentence string) ([]string, error) {
+	body, ok := strings.CutPrefix(sentence, "$")
+	if !ok {
+		return nil, errors.New("missing $")
+	}
+	body, checksum, ok := strings.Cut(body, "*")
+	if !ok {
+		return nil, errors.New("missing checksum")
+	}
+	want, err := strconv.ParseUint(checksum, 16, 8)
+	if err != nil {
+		return nil, fmt.Errorf("invalid checksum %q", checksum)
+	}
+	var sum byte
+	for i := 0; i < len(body); i++ {
+		sum ^= body[i]
+	}
+	if sum != byte(want) {
+		return nil, fmt.Errorf("checksum %02X, want %02X", sum, want)
+	}
+	return strings.Split(body, ","), nil
+}
+
+// nmeaCoordinate converts an NMEA coordinate such as "4807.038" with
+// hemisphere "N" to degrees.
+func nmeaCoordinate(value, hemisphere string) (float64, error) {
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, err
+	}
+	deg := math.Floor(v/100) + math.Mod(v, 100)/60
+	switch hemisphere {
+	case "N", "E":
+		return deg, nil
+	case "S", "W":
+		return -deg, nil
+	default:
+		return 0, fmt.Errorf("invalid hemisphere %q", hemisphere)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"math"
+	"slices"
+	"testing"
+)
+
+func TestParseNMEA(t *testing.T) {
+	tests := []struct {
+		name     string
+		sentence string
+		want     []string
+		wantErr  bool
+	}{
+		{
+			name:     "RMC",
+			sentence: "$GPRMC,123519,A,4807.038,N,01131.000,E,022.4,084.4,230394,003.1,W*6A",
+			want:     []string{"GPRMC", "123519", "A", "4807.038", "N", "01131.000", "E", "022.4", "084.4", "230394", "003.1", "W"},
+		},
+		{
+			name:     "lowercase checksum",
+			sentence: "$GPRMC,123519,A,4807.038,N,01131.000,E,022.4,084.4,230394,003.1,W*6a",
+			want:     []string{"GPRMC", "123519", "A", "4807.038", "N", "01131.000", "E", "022.4", "084.4", "230394", "003.1", "W"},
+		},
+		{
+			name:     "wrong checksum",
+			sentence: "$GPRMC,123519,A,4807.038,N,01131.000,E,022.4,084.4,230394,003.1,W*6B",
+			wantErr:  true,
+		},
+		{
+			name:     "missing checksum",
+			sentence: "$GPRMC,123519,A,4807.038,N,01131.000,E,022.4,084.4,230394,003.1,W",
+			wantErr:  true,
+		},
+		{
+			name:     "invalid checksum",
+			sentence: "$GPRMC,123519*XY",
+			wantErr:  true,
+		},
+		{
+			name:     "missing dollar",
+			sentence: "GPRMC,123519,A,4807.038,N,01131.000,E,022.4,084.4,230394,003.1,W*6A",
+			wantErr:  true,
+		},
+		{
+			name:     "empty",
+			sentence: "",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseNMEA(tt.sentence)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseNMEA(%q) error = %v, want error %v", tt.sentence, err, tt.wantErr)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("parseNMEA(%q) = %q, want %q", tt.sentence, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNMEACoordinate(t *testing.T) {
+	tests := []struct {
+		value, hemisphere string
+		want              float64
+		wantErr           bool
+	}{
+		{"4807.038", "N", 48.1173, false},
+		{"01131.000", "E", 11.516666666666667, false},
+		{"4807.038", "S", -48.1173, false},
+		{"01131.000", "W", -11.516666666666667, false},
+		{"0000.000", "N", 0, false},
+		{"8959.999", "N", 89.99998333333333, false},
+		{"4807.038", "X", 0, true},
+		{"4807.038", "", 0, true},
+		{"", "N", 0, true},
+		{"48o7.038", "N", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := nmeaCoordinate(tt.value, tt.hemisphere)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("nmeaCoordinate(%q, %q) error = %v, want error %v", tt.value, tt.hemisphere, err, tt.wantErr)
+			continue
+		}
+		if math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("nmeaCoordinate(%q, %q) = %v, want %v", tt.value, tt.hemisphere, got, tt.want)
+		}
+	}
+}
+
+func TestDegreesMinutesSeconds(t *testing.T) {
+	tests := []struct {
+		deg  float64
+		want [][2]uint32
+	}{
+		{0, [][2]uint32{{0, 1}, {0, 1}, {0, 1000}}},
+		{48.1173, [][2]uint32{{48, 1}, {7, 1}, {2280, 1000}}},
+		{-11.516666666666667, [][2]uint32{{11, 1}, {31, 1}, {0, 1000}}},
+		{180, [][2]uint32{{180, 1}, {0, 1}, {0, 1000}}},
+		// 10°59'59.9999" rounds up to 11°0'0.000", not to 10°59'60.000"
+		{10 + 59.0/60 + 59.9999/3600, [][2]uint32{{11, 1}, {0, 1}, {0, 1000}}},
+		// 10°0'59.9999" rounds up to 10°1'0.000"
+		{10 + 59.9999/3600, [][2]uint32{{10, 1}, {1, 1}, {0, 1000}}},
+	}
+	for _, tt := range tests {
+		if got := degreesMinutesSeconds(tt.deg); !slices.Equal(got, tt.want) {
+			t.Errorf("degreesMinutesSeconds(%v) = %v, want %v", tt.deg, got, tt.want)
+		}
+	}
+}
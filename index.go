@@ -0,0 +1,47 @@
+package main
+
+import (
+	"embed"
+	"html/template"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const viewerInterval = 5 * time.Second
+
+// webFS holds the dashboard page and the static files it loads, so the binary
+// runs without a web/ directory next to it.
+//
+//go:embed web/*
+var webFS embed.FS
+
+var indexTemplate = template.Must(template.ParseFS(webFS, "web/index.html"))
+
+// staticHandler serves the files in web/ at /static/.
+func staticHandler() http.Handler {
+	static, err := fs.Sub(webFS, "web")
+	if err != nil {
+		panic(err) // web is embedded, so it always exists
+	}
+	return http.StripPrefix("/static/", http.FileServer(http.FS(static)))
+}
+
+// indexHandler serves the dashboard page with the live feed and viewer count.
+func indexHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := indexTemplate.Execute(w, *cameraName); err != nil {
+		slog.Error("failed to render index page", "error", err)
+	}
+}
+
+// viewerMonitor publishes the number of stream viewers to /events clients
+// every viewerInterval.
+func viewerMonitor() {
+	defer logPanic("viewerMonitor")
+
+	for range time.Tick(viewerInterval) {
+		publishEvent("viewers", map[string]any{"count": viewerCount()})
+	}
+}
@@ -0,0 +1,116 @@
+//go:build !recorder
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// streamPart is a part read from /stream, or the error that ended the stream.
+type streamPart struct {
+	contentType string
+	body        []byte
+	err         error
+}
+
+// readStream parses the multipart /stream response and sends each part to
+// parts until the stream ends.
+func readStream(resp *http.Response, parts chan<- streamPart) {
+	defer close(parts)
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/x-mixed-replace" {
+		parts <- streamPart{err: err}
+		return
+	}
+	reader := multipart.NewReader(resp.Body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			parts <- streamPart{err: err}
+			return
+		}
+		body, err := io.ReadAll(part)
+		parts <- streamPart{contentType: part.Header.Get("Content-Type"), body: body, err: err}
+	}
+}
+
+func TestStreamIntegration(t *testing.T) {
+	const clients, frames = 2, 10
+
+	*warmupFrames = 0
+	clientCapacity.Store(int64(clientBuffer))
+	clientShards = nil
+	startBroadcastShards(broadcastShards)
+
+	mux := http.NewServeMux()
+	registerRoutes(mux)
+	handler, err := withMiddleware(mux)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+	defer srv.CloseClientConnections() // The streams never end by themselves
+
+	camera := newFakeCamera()
+	defer camera.Close()
+	go broadcastCamera(camera)
+
+	// The response headers only arrive with the first frame, so connect in the
+	// background and wait for the clients to be registered
+	streams := make([]chan streamPart, clients)
+	for i := range streams {
+		streams[i] = make(chan streamPart, frames)
+		go func(parts chan streamPart) {
+			resp, err := srv.Client().Get(srv.URL + "/stream")
+			if err != nil {
+				parts <- streamPart{err: err}
+				close(parts)
+				return
+			}
+			defer resp.Body.Close()
+			readStream(resp, parts)
+		}(streams[i])
+	}
+	for deadline := time.Now().Add(5 * time.Second); viewerCount() < clients; {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of %d clients connected", viewerCount(), clients)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A part only ends at the boundary written before the next frame, so frame
+	// i is checked once frame i+1 has been sent. That also keeps the shards
+	// idle when each frame arrives, so none are dropped.
+	sent := make([][]byte, frames+1)
+	for i := range sent {
+		sent[i] = testJPEG(t, uint8(i*20))
+		camera.frames <- sent[i]
+		if i == 0 {
+			continue
+		}
+		for c, parts := range streams {
+			select {
+			case part, ok := <-parts:
+				if !ok || part.err != nil {
+					t.Fatalf("client %d: stream ended before frame %d: %v", c, i-1, part.err)
+				}
+				if part.contentType != "image/jpeg" {
+					t.Errorf("client %d: frame %d has Content-Type %q", c, i-1, part.contentType)
+				}
+				if !bytes.Equal(part.body, sent[i-1]) {
+					t.Errorf("client %d: frame %d has %d bytes, want %d", c, i-1, len(part.body), len(sent[i-1]))
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("client %d: timed out waiting for frame %d", c, i-1)
+			}
+		}
+	}
+}
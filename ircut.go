@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"image"
+	"image/jpeg"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/warthog618/gpiod"
+)
+
+var (
+	gpioChip  = flag.String("gpio-chip", "gpiochip0", "GPIO chip that -gpio-pin, -ir-cut-pin and -ir-led-pin belong to")
+	irCutPin  = flag.Int("ir-cut-pin", -1, "BCM number of the GPIO pin driving the IR-cut filter, low in night mode (-1 disables)")
+	irLEDPin  = flag.Int("ir-led-pin", -1, "BCM number of the GPIO pin driving the IR LEDs, high in night mode (-1 disables)")
+	nightLuma = flag.Float64("night-luma", 30, "mean frame luma (0-255) below which night mode is switched on")
+	dayLuma   = flag.Float64("day-luma", 60, "mean frame luma (0-255) above which night mode is switched off after -day-luma has held for 30s")
+)
+
+const (
+	lumaEvery   = 10 // Only every lumaEvery-th frame is analyzed
+	dayHoldTime = 30 * time.Second
+)
+
+var (
+	lumaChan   = make(chan []byte, 1)
+	lumaFrames atomic.Uint64
+	nightMode  atomic.Bool
+)
+
+// offerLumaFrame hands every lumaEvery-th frame to dayNightMonitor without
+// blocking. It does nothing unless an IR pin is configured.
+func offerLumaFrame(frame []byte) {
+	if *irCutPin < 0 && *irLEDPin < 0 {
+		return
+	}
+	if lumaFrames.Add(1)%lumaEvery != 0 {
+		return
+	}
+	select {
+	case lumaChan <- frame:
+	default:
+	}
+}
+
+// meanLuma returns the average brightness of img, sampling every fourth pixel
+// in each direction.
+func meanLuma(img image.Image) float64 {
+	b := img.Bounds()
+	var sum, n float64
+	if ycc, ok := img.(*image.YCbCr); ok {
+		for y := b.Min.Y; y < b.Max.Y; y += 4 {
+			for x := b.Min.X; x < b.Max.X; x += 4 {
+				sum += float64(ycc.Y[ycc.YOffset(x, y)])
+				n++
+			}
+		}
+	} else {
+		for y := b.Min.Y; y < b.Max.Y; y += 4 {
+			for x := b.Min.X; x < b.Max.X; x += 4 {
+				r, g, bl, _ := img.At(x, y).RGBA()
+				sum += (0.299*float64(r) + 0.587*float64(g) + 0.114*float64(bl)) / 257
+				n++
+			}
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+	return sum / n
+}
+
+// irOutputs drives the IR-cut filter and IR LED pins.
+type irOutputs struct {
+	cut, led *gpiod.Line
+}
+
+// requestIROutputs requests the configured IR pins as outputs in day mode:
+// IR-cut filter high, LEDs low.
+func requestIROutputs() (*irOutputs, error) {
+	ir := &irOutputs{}
+	var err error
+	if *irCutPin >= 0 {
+		if ir.cut, err = gpiod.RequestLine(*gpioChip, *irCutPin, gpiod.AsOutput(1)); err != nil {
+			return nil, err
+		}
+	}
+	if *irLEDPin >= 0 {
+		if ir.led, err = gpiod.RequestLine(*gpioChip, *irLEDPin, gpiod.AsOutput(0)); err != nil {
+			return nil, err
+		}
+	}
+	return ir, nil
+}
+
+// set switches the pins to night or day mode.
+func (ir *irOutputs) set(night bool) {
+	cut, led := 1, 0
+	if night {
+		cut, led = 0, 1
+	}
+	if ir.cut != nil {
+		if err := ir.cut.SetValue(cut); err != nil {
+			slog.Error("failed to set IR-cut pin", "pin", *irCutPin, "error", err)
+		}
+	}
+	if ir.led != nil {
+		if err := ir.led.SetValue(led); err != nil {
+			slog.Error("failed to set IR LED pin", "pin", *irLEDPin, "error", err)
+		}
+	}
+}
+
+// dayNightMonitor measures the mean luma of frames from offerLumaFrame. It
+// switches to night mode as soon as the luma drops below -night-luma, and back
+// to day mode once it has stayed above -day-luma for dayHoldTime.
+func dayNightMonitor() {
+	defer logPanic("dayNightMonitor")
+
+	if *irCutPin < 0 && *irLEDPin < 0 {
+		return
+	}
+	ir, err := requestIROutputs()
+	if err != nil {
+		slog.Error("IR-cut control unavailable", "chip", *gpioChip, "error", err)
+		return
+	}
+
+	var brightSince time.Time
+	for frame := range lumaChan {
+		img, err := jpeg.Decode(bytes.NewReader(frame))
+		if err != nil {
+			continue
+		}
+		luma := meanLuma(img)
+
+		night := nightMode.Load()
+		switch {
+		case !night && luma < *nightLuma:
+			slog.Info("switching to night mode", "luma", int(luma), "night_luma", *nightLuma)
+		case night && luma > *dayLuma:
+			if brightSince.IsZero() {
+				brightSince = time.Now()
+			}
+			if time.Since(brightSince) < dayHoldTime {
+				continue
+			}
+			slog.Info("switching to day mode", "luma", int(luma), "day_luma", *dayLuma)
+		default:
+			brightSince = time.Time{}
+			continue
+		}
+		brightSince = time.Time{}
+		nightMode.Store(!night)
+		ir.set(!night)
+		publishEvent("day_night", map[string]any{
+			"night":     !night,
+			"luma":      luma,
+			"timestamp": time.Now().Format(time.RFC3339),
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var degradeUnderLoad = flag.Bool("degrade-under-load", false, "lower re-encoding quality, recording bitrate and software encoder preset while the CPU is saturated")
+
+// The CPU is sampled every loadInterval. Quality is lowered after loadSamples
+// samples in a row above highLoadPercent and restored after as many below
+// lowLoadPercent.
+const (
+	loadInterval    = 5 * time.Second
+	loadSamples     = 2
+	highLoadPercent = 90
+	lowLoadPercent  = 70
+)
+
+// degradedJPEGQuality replaces processedJPEGQuality while the CPU is saturated.
+const degradedJPEGQuality = 60
+
+var underLoad atomic.Bool
+
+// onLoadChange, when set, is called after underLoad changes.
+var onLoadChange func(degraded bool)
+
+// processedQuality returns the quality processed frames are re-encoded at.
+func processedQuality() int {
+	if underLoad.Load() {
+		return degradedJPEGQuality
+	}
+	return processedJPEGQuality
+}
+
+// readCPUTimes returns the total and idle jiffies of all CPUs from /proc/stat.
+func readCPUTimes() (total, idle uint64, err error) {
+	f, err := os.Open("/proc/stat")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		return 0, 0, errors.New("empty /proc/stat")
+	}
+	// cpu  user nice system idle iowait irq softirq steal ...
+	fields := strings.Fields(scanner.Text())
+	if len(fields) < 5 || fields[0] != "cpu" {
+		return 0, 0, errors.New("unexpected /proc/stat format")
+	}
+	for i, field := range fields[1:] {
+		v, err := strconv.ParseUint(field, 10, 64)
+		if err != nil {
+			return 0, 0, err
+		}
+		total += v
+		if i == 3 || i == 4 { // idle and iowait
+			idle += v
+		}
+	}
+	return total, idle, nil
+}
+
+// loadMonitor samples CPU usage every loadInterval and sets underLoad when the
+// CPU has been saturated for loadSamples samples, clearing it again once usage
+// stays low for as long.
+func loadMonitor() {
+	defer logPanic("loadMonitor")
+
+	if !*degradeUnderLoad {
+		return
+	}
+	prevTotal, prevIdle, err := readCPUTimes()
+	if err != nil {
+		slog.Warn("CPU load monitoring unavailable", "error", err)
+		return
+	}
+
+	var high, low int
+	for range time.Tick(loadInterval) {
+		total, idle, err := readCPUTimes()
+		if err != nil {
+			slog.Error("failed to read CPU usage", "error", err)
+			continue
+		}
+		if total == prevTotal {
+			continue
+		}
+		usage := 100 * (1 - float64(idle-prevIdle)/float64(total-prevTotal))
+		prevTotal, prevIdle = total, idle
+
+		switch {
+		case usage > highLoadPercent:
+			high, low = high+1, 0
+		case usage < lowLoadPercent:
+			high, low = 0, low+1
+		default:
+			high, low = 0, 0
+		}
+
+		degraded := underLoad.Load()
+		switch {
+		case !degraded && high >= loadSamples:
+			slog.Warn("CPU saturated, lowering quality", "cpu_percent", int(usage), "jpeg_quality", degradedJPEGQuality)
+		case degraded && low >= loadSamples:
+			slog.Info("CPU load recovered, restoring quality", "cpu_percent", int(usage), "jpeg_quality", processedJPEGQuality)
+		default:
+			continue
+		}
+		underLoad.Store(!degraded)
+		if onLoadChange != nil {
+			onLoadChange(!degraded)
+		}
+	}
+}
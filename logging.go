@@ -0,0 +1,67 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"runtime/debug"
+	"strings"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+var (
+	logLevel      = flag.String("log-level", "info", "log level: debug, info, warn or error")
+	logFormat     = flag.String("log-format", "text", "log output format: text or json")
+	logFile       = flag.String("log-file", "", "also write logs to this file, rotating it by size (empty logs to stderr only)")
+	logMaxSizeMB  = flag.Int("log-max-size-mb", 100, "size in MB at which -log-file is rotated")
+	logRetainDays = flag.Int("log-retain-days", 7, "days rotated log files are kept")
+)
+
+// setupLogger installs the default slog logger from the -log-* flags.
+func setupLogger() error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		return fmt.Errorf("invalid log level %q: %w", *logLevel, err)
+	}
+
+	var out io.Writer = os.Stderr
+	if *logFile != "" {
+		out = io.MultiWriter(os.Stderr, &lumberjack.Logger{
+			Filename: *logFile,
+			MaxSize:  *logMaxSizeMB,
+			MaxAge:   *logRetainDays,
+		})
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch strings.ToLower(*logFormat) {
+	case "text":
+		handler = slog.NewTextHandler(out, opts)
+	case "json":
+		handler = slog.NewJSONHandler(out, opts)
+	default:
+		return fmt.Errorf("invalid log format %q", *logFormat)
+	}
+
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// logPanic recovers a panic in the goroutine named name and logs it with a
+// stack trace instead of crashing the server. It must be deferred.
+func logPanic(name string) {
+	if r := recover(); r != nil {
+		slog.Error("panic", "goroutine", name, "error", r)
+		debug.PrintStack()
+	}
+}
+
+// fatal logs msg at error level and exits the process.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
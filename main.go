@@ -1,97 +1,120 @@
+//go:build !recorder
+
 package main
 
 import (
-	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"html/template"
-	"log"
-	"mime/multipart"
+	"log/slog"
 	"net/http"
-	_ "net/http/pprof"
 	"net/textproto"
 	"os"
-	"path/filepath"
-	"sync"
-
-	"github.com/vladimirvivien/go4vl/device"
-	"github.com/vladimirvivien/go4vl/v4l2"
+	"time"
 )
 
 type ClientChan chan []byte
 
+// clientInfo describes a connected stream client.
+type clientInfo struct {
+	remoteAddr string
+	connected  time.Time
+}
+
 var (
-	frames       <-chan []byte
-	cameraDevice *device.Device
-	devName      = "/dev/video99"
-	clients      = make(map[ClientChan]struct{})
-	clientsMutex sync.Mutex
+	clientBuffer    = 30 // Per-client frame buffer size
+	broadcastShards = 1  // Number of client shards frames are fanned out to
+
+	processorList = "" // Comma-separated frame processors, see frameProcessors
+	previewEvery  = 15 // Frames per frame sent on /stream/preview
 )
 
-// setupCamera initializes the camera device and starts the stream.
-func setupCamera() (*device.Device, error) {
-	camera, err := device.Open(
-		devName,
-		device.WithPixFormat(v4l2.PixFormat{PixelFormat: v4l2.PixelFmtMJPEG, Width: 1280, Height: 720}),
-	)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open device: %w", err)
-	}
+// Broadcast frames to another channel for all incoming clients to use
+func frameBroadcaster() {
+	defer logPanic("frameBroadcaster")
 
-	if err := camera.Start(context.TODO()); err != nil {
-		camera.Close()
-		return nil, fmt.Errorf("camera start: %w", err)
+	for {
+		// The output is closed when the camera restarts, so wait for the new one
+		broadcastCamera(waitForCamera())
 	}
-
-	return camera, nil
 }
 
-// Broadcast frames to another channel for all incoming clients to use
-func frameBroadcaster() {
-	// Get raw frames from the camera (these frames should be MJPEG images)
-	frames := cameraDevice.GetOutput()
-	for frame := range frames {
+// broadcastCamera processes the frames of camera until its output is closed.
+func broadcastCamera(camera frameSource) {
+	// Raw frames are MJPEG images unless -pixel-format is raw
+	var last time.Time
+	warmup := *warmupFrames
+	for frame := range camera.GetOutput() {
 		// Check if the frame is empty or invalid
 		if len(frame) == 0 {
-			log.Println("Received empty frame, skipping...")
+			slog.Warn("received empty frame, skipping")
 			continue
 		}
-		// Send the raw frame to the global channel for clients
-		clientsMutex.Lock()
-		for clientChan := range clients {
-			select {
-			case clientChan <- frame:
-			default:
-				// Drop frame
+		// The first frames are often dark while AGC and AWB converge
+		if warmup > 0 {
+			if warmup--; warmup == 0 {
+				slog.Debug("camera warmed up", "discarded_frames", *warmupFrames)
 			}
+			continue
+		}
+		jpegFrame, err := frameToJPEG(camera, frame)
+		if err != nil {
+			slog.Debug("failed to encode raw frame, skipping", "pixel_format", *pixelFormat, "error", err)
+			continue
+		}
+		frame = jpegFrame
+		if !validJPEG(frame) {
+			invalidFrames.Inc()
+			slog.Debug("received incomplete JPEG frame, skipping", "bytes", len(frame))
+			continue
+		}
+		measureFrame()
+		offerLumaFrame(frame)
+
+		offerMotionFrame(frame)
+		duplicate := isDuplicateFrame(frame)
+		frame = applyProcessors(frame)
+		storeLatestFrame(frame)
+		if !duplicate {
+			// Send the raw frame to the client shards
+			broadcastFrame(frame)
+			writeDashFrame(frame)
 		}
-		clientsMutex.Unlock()
-	}
-}
 
-func resetCameraWeb(w http.ResponseWriter, req *http.Request) {
-	fmt.Println("Restarting camera")
-	restartCamera()
-	fmt.Fprint(w, "Camera restarted.")
+		// Hold off reading the next frame if the camera runs faster than -fps-cap
+		last = capFrameRate(last)
+	}
 }
 
 // Serve the stream of frames to the client
 func imageServ(w http.ResponseWriter, req *http.Request) {
-	fmt.Println("Client connected", req.RemoteAddr)
-	clientChan := make(ClientChan, 30) // Per-client buffer
-	clientsMutex.Lock()
-	clients[clientChan] = struct{}{}
-	clientsMutex.Unlock()
-
-	defer func() {
-		clientsMutex.Lock()
-		delete(clients, clientChan)
-		clientsMutex.Unlock()
-		close(clientChan)
-		fmt.Println("Client disconnected", req.RemoteAddr)
-	}()
-
-	mimeWriter := multipart.NewWriter(w)
+	serveStream(w, req, 1)
+}
+
+// previewServ serves every -preview-every-th frame, about one per second, for
+// dashboards that only need a live thumbnail.
+func previewServ(w http.ResponseWriter, req *http.Request) {
+	serveStream(w, req, previewEvery)
+}
+
+// serveStream streams every n-th camera frame to the client.
+func serveStream(w http.ResponseWriter, req *http.Request, n int) {
+	processors, err := streamProcessors(req.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	pushSnapshot(w, req)
+	rc := http.NewResponseController(w)
+	// A write past the deadline fails at once, so a stale client's handler
+	// returns even while blocked on its connection
+	abort := func() { rc.SetWriteDeadline(time.Now()) }
+	shard, client, clientChan := addClient(clientInfo{remoteAddr: req.RemoteAddr, connected: time.Now()}, abort)
+	defer shard.removeClient(client)
+
+	mimeWriter := newStreamWriter(w)
 	defer mimeWriter.Close()
 
 	w.Header().Set("Content-Type", fmt.Sprintf("multipart/x-mixed-replace; boundary=%s", mimeWriter.Boundary()))
@@ -99,127 +122,195 @@ func imageServ(w http.ResponseWriter, req *http.Request) {
 	partHeader := make(textproto.MIMEHeader)
 	partHeader.Add("Content-Type", "image/jpeg")
 
-	for {
+	limiter := newBandwidthLimiter(*maxBandwidthKbps)
+
+	for count := 0; ; {
 		select {
 		case frame, ok := <-clientChan:
 			if !ok {
-				return
+				// The channel was replaced by a larger one
+				if clientChan = shard.next(client); clientChan == nil {
+					return
+				}
+				continue
+			}
+			if count++; (count-1)%n != 0 {
+				continue
+			}
+
+			if len(processors) > 0 {
+				if processed, err := processFrame(processors, frame); err == nil {
+					frame = processed
+				} else {
+					slog.Debug("failed to process frame for client", "client", req.RemoteAddr, "error", err)
+				}
+			}
+
+			if limiter != nil {
+				if err := waitBandwidth(req.Context(), limiter, len(frame), *bandwidthTimeout); err != nil {
+					slog.Error("client exceeded bandwidth limit, dropping", "client", req.RemoteAddr, "error", err)
+					return
+				}
 			}
 
+			warnBoundaryCollision(frame, mimeWriter.Boundary())
 			part, err := mimeWriter.CreatePart(partHeader)
 			if err != nil {
-				log.Printf("CreatePart failed: %v", err)
+				slog.Error("CreatePart failed", "client", req.RemoteAddr, "error", err)
 				return
 			}
 
-			if _, err := part.Write(frame); err != nil {
-				log.Printf("Write failed: %v", err)
+			if err := writeWithDeadline(rc, part, frame); err != nil {
+				if errors.Is(err, os.ErrDeadlineExceeded) {
+					slog.Warn("stream write timed out, closing client", "client", req.RemoteAddr)
+					return
+				}
+				slog.Error("write failed", "client", req.RemoteAddr, "error", err)
 				return
 			}
+			client.lastWrite.Store(time.Now().UnixNano())
 		case <-req.Context().Done():
 			return
 		}
 	}
 }
 
-// restartCamera stops and reopens the camera device.
-func restartCamera() {
-	if cameraDevice != nil {
-		cameraDevice.Close()
-	}
-	var err error
-	cameraDevice, err = setupCamera()
-	if err != nil {
-		log.Printf("failed to restart camera: %s", err)
-	}
+// clientStats is the buffer utilization of a single stream client.
+type clientStats struct {
+	RemoteAddr  string    `json:"remote_addr"`
+	Connected   time.Time `json:"connected"`
+	Len         int       `json:"len"`
+	Cap         int       `json:"cap"`
+	Utilization float64   `json:"utilization"`
 }
 
-var videoDir = "/home/elff/webcam-sv/mycode/clips" // Directory containing video files
-
-// listVideosHandler lists all .mkv files in the video directory and provides download links.
-func listVideosHandler(w http.ResponseWriter, r *http.Request) {
-	files, err := os.ReadDir(videoDir)
-	if err != nil {
-		http.Error(w, "Unable to read directory", http.StatusInternalServerError)
-		return
-	}
-
-	var videoFiles []string
-	for _, file := range files {
-		if !file.IsDir() && filepath.Ext(file.Name()) == ".mkv" || filepath.Ext(file.Name()) == ".zip" {
-			videoFiles = append(videoFiles, file.Name())
+// clientStatsHandler reports how full each client's frame buffer is.
+func clientStatsHandler(w http.ResponseWriter, r *http.Request) {
+	stats := []clientStats{}
+	for _, shard := range clientShards {
+		shard.mutex.Lock()
+		for client := range shard.clients {
+			s := clientStats{
+				RemoteAddr: client.info.remoteAddr,
+				Connected:  client.info.connected,
+				Len:        len(client.frames),
+				Cap:        cap(client.frames),
+			}
+			if s.Cap > 0 {
+				s.Utilization = float64(s.Len) / float64(s.Cap)
+			}
+			stats = append(stats, s)
 		}
+		shard.mutex.Unlock()
 	}
 
-	// Define the HTML template for listing files
-	const tpl = `
-	<!DOCTYPE html>
-	<html>
-	<head>
-		<title>Video List</title>
-	</head>
-	<body>
-		<h1>Available Videos</h1>
-		<table border="1">
-			<tr>
-				<th>Filename</th>
-				<th>Action</th>
-			</tr>
-			{{range .}}
-			<tr>
-				<td>{{.}}</td>
-				<td><a href="/download/{{.}}">Download</a></td>
-			</tr>
-			{{end}}
-		</table>
-	</body>
-	</html>
-	`
-
-	tmpl, err := template.New("videoList").Parse(tpl)
-	if err != nil {
-		http.Error(w, "Unable to parse template", http.StatusInternalServerError)
-		return
-	}
-
-	err = tmpl.Execute(w, videoFiles)
-	if err != nil {
-		http.Error(w, "Unable to execute template", http.StatusInternalServerError)
-		return
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		slog.Error("failed to encode client stats", "error", err)
 	}
 }
 
-// downloadHandler serves video files for download.
-func downloadHandler(w http.ResponseWriter, r *http.Request) {
-	fileName := r.URL.Path[len("/download/"):]
-
-	filePath := filepath.Join(videoDir, fileName)
-	http.ServeFile(w, r, filePath)
+// registerBuildRoutes adds the endpoints only the streaming build has to mux.
+func registerBuildRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /stream/preview", limitConnections(previewServ))
+	mux.HandleFunc("/api/stats/clients", clientStatsHandler)
+	mux.HandleFunc("POST /api/webrtc/offer", webrtcOfferHandler)
 }
 
 func main() {
 	port := ":8080"
 	flag.StringVar(&port, "p", port, "webcam service port")
+	flag.StringVar(&devName, "device", devName, "V4L2 camera device")
+	flag.StringVar(&videoDir, "video-dir", videoDir, "directory of the recorded clips served on /videos")
+	flag.IntVar(&clientBuffer, "client-buffer", clientBuffer, "per-client frame buffer size")
+	flag.IntVar(&broadcastShards, "broadcast-shards", broadcastShards, "number of goroutines, each owning a share of the stream clients, that frames are fanned out to")
+	flag.IntVar(&previewEvery, "preview-every", previewEvery, "send every n-th camera frame on /stream/preview")
+	flag.StringVar(&processorList, "processor", processorList, "comma-separated frame processors applied in order: grayscale, flip-h, blur, timestamp, exif-time (last, as the others re-encode without Exif)")
 	flag.Parse()
 
 	var err error
-	cameraDevice, err = setupCamera()
+	if err = setupLogger(); err != nil {
+		fatal("invalid logging configuration", "error", err)
+	}
+	if err = checkContainer(); err != nil {
+		fatal("invalid container format", "error", err)
+	}
+	if err = checkBoundary(); err != nil {
+		fatal("invalid multipart boundary", "boundary", *streamBoundary, "error", err)
+	}
+	if err = checkPixelFormat(); err != nil {
+		fatal("invalid pixel format", "error", err)
+	}
+	if err = startGPS(); err != nil {
+		fatal("invalid GPS configuration", "error", err)
+	}
+	if err = checkPNGCompression(); err != nil {
+		fatal("invalid PNG compression", "error", err)
+	}
+	if clientBuffer < 1 {
+		fatal("invalid client buffer size", "client-buffer", clientBuffer)
+	}
+	clientCapacity.Store(int64(clientBuffer))
+	if previewEvery < 1 {
+		fatal("invalid preview frame interval", "preview-every", previewEvery)
+	}
+	if broadcastShards < 1 {
+		fatal("invalid broadcast shard count", "broadcast-shards", broadcastShards)
+	}
+	if processorChain, err = newProcessorChain(processorList); err != nil {
+		fatal("invalid frame processors", "error", err)
+	}
+
+	clipStore, err = newClipStore()
 	if err != nil {
-		log.Fatalf("failed to initialize camera: %s", err)
+		fatal("failed to initialize clip store", "error", err)
 	}
-	defer cameraDevice.Close()
 
-	log.Printf("Serving images on [%s/stream]", port)
-	http.HandleFunc("/stream", imageServ)
-	http.HandleFunc("/videos", listVideosHandler)
-	http.HandleFunc("/download/", downloadHandler)
-	http.HandleFunc("/restart", resetCameraWeb)
+	if err = openCamera(); err != nil {
+		fatal("failed to initialize camera", "device", devName, "error", err)
+	}
+	defer closeCamera()
 
+	slog.Info("serving images", "url", port+"/stream")
+	registerRoutes(http.DefaultServeMux)
+	if *onvifEnabled {
+		startONVIF(port)
+	}
+
+	startBroadcastShards(broadcastShards)
+	if err := startDash(); err != nil {
+		fatal("failed to start DASH stream", "error", err)
+	}
 	go frameBroadcaster()
-	// go func() {
-	// 	log.Println("Starting pprof server on :6060")
-	// 	log.Println(http.ListenAndServe(":6060", nil))
-	// }()
+	go clientWatchdog()
+	go continuityMonitor()
+	go diskMonitor()
+	go memoryMonitor()
+	go viewerMonitor()
+	go fpsMonitor()
+	go dayNightMonitor()
+	go loadMonitor()
 
-	log.Fatal(http.ListenAndServe(port, nil))
+	detector, err := newMotionDetector(*motionAlgo, *motionThreshold)
+	if err != nil {
+		fatal("invalid motion detection configuration", "error", err)
+	}
+	if detector != nil {
+		go motionMonitor(detector)
+	}
+	if err := startPprof(port); err != nil {
+		fatal("invalid pprof configuration", "error", err)
+	}
+
+	handler, err := withMiddleware(http.DefaultServeMux)
+	if err != nil {
+		fatal("invalid middleware configuration", "error", err)
+	}
+	srv, err := newServer(port, handler)
+	if err != nil {
+		fatal("invalid TLS configuration", "error", err)
+	}
+	if err := listenAndServe(srv); err != nil {
+		fatal("http server stopped", "error", err)
+	}
 }
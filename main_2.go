@@ -1,114 +1,88 @@
+//go:build recorder
+
 package main
 
 import (
-	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"html/template"
-	"log"
-	"mime/multipart"
+	"log/slog"
 	"net/http"
-	_ "net/http/pprof"
 	"net/textproto"
 	"os"
-	"os/exec"
-	"path/filepath"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
 	"time"
-
-	"github.com/vladimirvivien/go4vl/device"
-	"github.com/vladimirvivien/go4vl/v4l2"
 )
 
 var (
-	frames           <-chan []byte
-	cameraDevice     *device.Device
-	devName          = "/dev/video99"
+	httpFrames       = make(chan []byte, 2) // Frames for httpBroadcaster
 	encodedFrameChan = make(chan []byte, 10)
+	streamViewers    atomic.Int64 // Clients connected to /stream
+	processorList    = ""         // Comma-separated frame processors, see frameProcessors
 )
 
-// setupCamera initializes the camera device and starts the stream.
-func setupCamera() (*device.Device, error) {
-	camera, err := device.Open(
-		devName,
-		device.WithPixFormat(v4l2.PixFormat{PixelFormat: v4l2.PixelFmtMJPEG, Width: 1280, Height: 720}),
-	)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open device: %w", err)
-	}
-
-	if err := camera.Start(context.TODO()); err != nil {
-		camera.Close()
-		return nil, fmt.Errorf("camera start: %w", err)
-	}
-
-	return camera, nil
-}
-
 // Broadcast frames to another channel for all incoming clients to use
 func frameBroadcaster() {
-	// Start the FFmpeg subprocess to write to an MKV file with H.264 compression and segmentation
-	cmd := exec.Command(
-		"ffmpeg",
-		"-loglevel", "debug", // Enable debug level logging for FFmpeg
-		"-y",          // Overwrite output file if it exists
-		"-f", "mjpeg", // MJPEG format (because frames are JPEG images)
-		"-framerate", "15",
-		"-i", "pipe:0", // Read input from stdin (pipe)
-		"-vf", "drawtext=text='%{localtime}':fontcolor=white:fontsize=24:x=10:y=10",
-		"-c:v", "h264_v4l2m2m", // H.264 encoding for output // Pixel format for output video
-		"-crf", "0", // Lossless quality (zero compression)
-		"-pix_fmt", "yuv420p",
-		"-b:v", "1M", // Bitrate for video encoding
-		"-f", "segment",
-		"-r", "15", // Force framerate
-		"-reset_timestamps", "1",
-		"-use_wallclock_as_timestamps", "1",
-		"-segment_time", "1800", // Segment duration (30 minutes)
-		"-segment_format", "mkv", // MKV format for segmented files
-		"-segment_atclocktime", "1", // Reset timestamps at each segment
-		"-strftime", "1",
-		"-vsync", "2",
-		"clips/compressed_%Y%m%dT%H%M%S.mkv",
-	)
-
-	// Create a pipe for sending raw MJPEG frames to FFmpeg
-	ffmpegIn, err := cmd.StdinPipe()
-	if err != nil {
-		log.Fatalf("Failed to create FFmpeg stdin pipe: %s", err)
-	}
+	defer logPanic("frameBroadcaster")
 
-	// Start the FFmpeg process
-	if err := cmd.Start(); err != nil {
-		log.Fatalf("Failed to start FFmpeg process: %s", err)
+	for {
+		// The output is closed when the camera restarts, so wait for the new one
+		broadcastCamera(waitForCamera())
 	}
+}
 
-	// Close ffmpegIn and wait for the command to finish when done
-	defer func() {
-		ffmpegIn.Close() // Close the pipe when done
-		cmd.Wait()       // Wait for FFmpeg to finish
-	}()
-
-	// Get raw frames from the camera (these frames should be MJPEG images)
-	frames := cameraDevice.GetOutput()
-	for frame := range frames {
+// broadcastCamera processes the frames of camera until its output is closed.
+func broadcastCamera(camera frameSource) {
+	// Raw frames are MJPEG images unless -pixel-format is raw
+	var last time.Time
+	warmup := *warmupFrames
+	for frame := range camera.GetOutput() {
 		// Check if the frame is empty or invalid
 		if len(frame) == 0 {
-			log.Println("Received empty frame, skipping...")
+			slog.Warn("received empty frame, skipping")
 			continue
 		}
-
-		// Write the raw MJPEG frame (JPEG image) to FFmpeg's stdin
-		_, err = ffmpegIn.Write(frame)
+		// The first frames are often dark while AGC and AWB converge
+		if warmup > 0 {
+			if warmup--; warmup == 0 {
+				slog.Debug("camera warmed up", "discarded_frames", *warmupFrames)
+			}
+			continue
+		}
+		jpegFrame, err := frameToJPEG(camera, frame)
 		if err != nil {
-			log.Printf("Failed to write frame to FFmpeg: %s", err)
-			return // Exit if writing to FFmpeg fails
+			slog.Debug("failed to encode raw frame, skipping", "pixel_format", *pixelFormat, "error", err)
+			continue
 		}
-
-		// Optionally, send the raw frame to the global channel for clients
-		select {
-		case encodedFrameChan <- frame:
-		default:
-			log.Println("Frame channel full, dropping frame to keep up with the camera.")
+		frame = jpegFrame
+		if !validJPEG(frame) {
+			invalidFrames.Inc()
+			slog.Debug("received incomplete JPEG frame, skipping", "bytes", len(frame))
+			continue
+		}
+		measureFrame()
+		offerLumaFrame(frame)
+
+		offerMotionFrame(frame)
+		duplicate := isDuplicateFrame(frame)
+		frame = applyProcessors(frame)
+		storeLatestFrame(frame)
+
+		if !duplicate {
+			// Fan out to the HTTP clients and the recording independently, so
+			// a stalled FFmpeg does not hold up the stream or the reverse
+			select {
+			case httpFrames <- frame:
+			default:
+				slog.Debug("HTTP broadcaster busy, dropping frame")
+			}
+			select {
+			case recordChan <- frame:
+			default:
+				slog.Debug("recording writer busy, dropping frame")
+			}
 		}
 
 		// Reset camera every 30 Minutes 1-2 times to try and remove the obscure lag
@@ -117,133 +91,233 @@ func frameBroadcaster() {
 		second := currTime.Second()
 		if minute == 30 || minute == 0 {
 			if second >= 0 && second <= 2 {
-				fmt.Println("Restarting Camera...")
+				slog.Info("restarting camera on schedule to clear lag")
 				restartCamera()
 			}
 		}
+
+		// Hold off reading the next frame if the camera runs faster than -fps-cap
+		last = capFrameRate(last)
 	}
 }
 
+// httpBroadcaster hands the frames from frameBroadcaster to the /stream
+// clients and the DASH encoder.
+func httpBroadcaster() {
+	defer logPanic("httpBroadcaster")
+
+	for frame := range httpFrames {
+		writeDashFrame(frame)
+		select {
+		case encodedFrameChan <- frame:
+		default:
+			slog.Debug("frame channel full, dropping frame to keep up with the camera")
+		}
+	}
+}
+
+// viewerCount returns the number of clients connected to /stream.
+func viewerCount() int {
+	return int(streamViewers.Load())
+}
+
 // Serve the stream of frames to the client
 func imageServ(w http.ResponseWriter, req *http.Request) {
-	mimeWriter := multipart.NewWriter(w)
+	processors, err := streamProcessors(req.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	pushSnapshot(w, req)
+	streamViewers.Add(1)
+	defer streamViewers.Add(-1)
+
+	mimeWriter := newStreamWriter(w)
 	w.Header().Set("Content-Type", fmt.Sprintf("multipart/x-mixed-replace; boundary=%s", mimeWriter.Boundary()))
 	defer mimeWriter.Close()
 
 	partHeader := make(textproto.MIMEHeader)
 	partHeader.Add("Content-Type", "image/jpeg")
 
+	rc := http.NewResponseController(w)
+	limiter := newBandwidthLimiter(*maxBandwidthKbps)
 	for frame := range encodedFrameChan {
+		if len(processors) > 0 {
+			if processed, err := processFrame(processors, frame); err == nil {
+				frame = processed
+			} else {
+				slog.Debug("failed to process frame for client", "client", req.RemoteAddr, "error", err)
+			}
+		}
+
+		if limiter != nil {
+			if err := waitBandwidth(req.Context(), limiter, len(frame), *bandwidthTimeout); err != nil {
+				slog.Error("client exceeded bandwidth limit, dropping", "client", req.RemoteAddr, "error", err)
+				return
+			}
+		}
+
+		warnBoundaryCollision(frame, mimeWriter.Boundary())
 		partWriter, err := mimeWriter.CreatePart(partHeader)
 		if err != nil {
-			log.Printf("failed to create multi-part writer: %s", err)
+			slog.Error("failed to create multi-part writer", "error", err)
 			return
 		}
 
-		if _, err := partWriter.Write(frame); err != nil {
-			log.Printf("failed to write compressed image: %s", err)
+		if err := writeWithDeadline(rc, partWriter, frame); err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				slog.Warn("stream write timed out, closing client", "client", req.RemoteAddr)
+				return
+			}
+			slog.Error("failed to write compressed image", "error", err)
 			return
 		}
 	}
 }
 
-// restartCamera stops and reopens the camera device.
-func restartCamera() {
-	if cameraDevice != nil {
-		cameraDevice.Close()
-	}
+// registerBuildRoutes adds the endpoints only the recorder build has to mux.
+// There are none: /dash/ is added by startDash when -dash is set.
+func registerBuildRoutes(mux *http.ServeMux) {}
+
+func main() {
+	port := ":8080"
+	flag.StringVar(&port, "p", port, "webcam service port")
+	flag.StringVar(&devName, "device", devName, "V4L2 camera device")
+	flag.StringVar(&videoDir, "video-dir", videoDir, "directory clips are recorded to, and served from unless -clip-store is s3")
+	flag.StringVar(&processorList, "processor", processorList, "comma-separated frame processors applied in order: grayscale, flip-h, blur, timestamp, exif-time (last, as the others re-encode without Exif)")
+	flag.Parse()
+
 	var err error
-	cameraDevice, err = setupCamera()
+	if err = setupLogger(); err != nil {
+		fatal("invalid logging configuration", "error", err)
+	}
+	if err = checkContainer(); err != nil {
+		fatal("invalid container format", "error", err)
+	}
+	if err = checkSegmentName(); err != nil {
+		fatal("invalid segment name", "segment-name", *segmentName, "error", err)
+	}
+	if err = checkBoundary(); err != nil {
+		fatal("invalid multipart boundary", "boundary", *streamBoundary, "error", err)
+	}
+	if err = checkPixelFormat(); err != nil {
+		fatal("invalid pixel format", "error", err)
+	}
+	if err = startGPS(); err != nil {
+		fatal("invalid GPS configuration", "error", err)
+	}
+	if err = checkPNGCompression(); err != nil {
+		fatal("invalid PNG compression", "error", err)
+	}
+	if processorChain, err = newProcessorChain(processorList); err != nil {
+		fatal("invalid frame processors", "error", err)
+	}
+
+	clipStore, err = newClipStore()
 	if err != nil {
-		log.Printf("failed to restart camera: %s", err)
+		fatal("failed to initialize clip store", "error", err)
 	}
-}
 
-var videoDir = "/home/elff/webcam-sv/mycode/clips" // Directory containing video files
+	if err = openCamera(); err != nil {
+		fatal("failed to initialize camera", "device", devName, "error", err)
+	}
 
-// listVideosHandler lists all .mkv files in the video directory and provides download links.
-func listVideosHandler(w http.ResponseWriter, r *http.Request) {
-	files, err := os.ReadDir(videoDir)
-	if err != nil {
-		http.Error(w, "Unable to read directory", http.StatusInternalServerError)
-		return
+	slog.Info("serving images", "url", port+"/stream")
+	registerRoutes(http.DefaultServeMux)
+	if *onvifEnabled {
+		startONVIF(port)
 	}
 
-	var videoFiles []string
-	for _, file := range files {
-		if !file.IsDir() && filepath.Ext(file.Name()) == ".mkv" || filepath.Ext(file.Name()) == ".zip" {
-			videoFiles = append(videoFiles, file.Name())
+	if *videoEncoderName != "" {
+		if err := useEncoder(*videoEncoderName); err != nil {
+			fatal("invalid video encoder", "error", err)
 		}
+	} else {
+		go probeEncoders()
 	}
 
-	// Define the HTML template for listing files
-	const tpl = `
-	<!DOCTYPE html>
-	<html>
-	<head>
-		<title>Video List</title>
-	</head>
-	<body>
-		<h1>Available Videos</h1>
-		<table border="1">
-			<tr>
-				<th>Filename</th>
-				<th>Action</th>
-			</tr>
-			{{range .}}
-			<tr>
-				<td>{{.}}</td>
-				<td><a href="/download/{{.}}">Download</a></td>
-			</tr>
-			{{end}}
-		</table>
-	</body>
-	</html>
-	`
-
-	tmpl, err := template.New("videoList").Parse(tpl)
+	interrupted, err := loadState()
 	if err != nil {
-		http.Error(w, "Unable to parse template", http.StatusInternalServerError)
-		return
+		slog.Error("failed to read state file", "error", err)
 	}
-
-	err = tmpl.Execute(w, videoFiles)
-	if err != nil {
-		http.Error(w, "Unable to execute template", http.StatusInternalServerError)
-		return
+	if len(interrupted) > 0 {
+		go recoverSegments(interrupted)
 	}
-}
-
-// downloadHandler serves video files for download.
-func downloadHandler(w http.ResponseWriter, r *http.Request) {
-	fileName := r.URL.Path[len("/download/"):]
-
-	filePath := filepath.Join(videoDir, fileName)
-	http.ServeFile(w, r, filePath)
-}
 
-func main() {
-	port := ":8080"
-	flag.StringVar(&port, "p", port, "webcam service port")
-	flag.Parse()
+	if err := startSegmentUploads(); err != nil {
+		fatal("failed to start segment uploads", "error", err)
+	}
 
-	var err error
-	cameraDevice, err = setupCamera()
+	start, stop, err := parseRecordSchedule()
 	if err != nil {
-		log.Fatalf("failed to initialize camera: %s", err)
+		fatal("invalid recording schedule", "error", err)
+	}
+	if start != nil {
+		go recordScheduler(start, stop)
+	} else if *gpioPin < 0 {
+		if err := startRecording(); err != nil {
+			fatal("failed to start recording", "error", err)
+		}
+	}
+	if err := startGPIO(); err != nil {
+		fatal("failed to watch GPIO pin", "chip", *gpioChip, "pin", *gpioPin, "error", err)
 	}
-	defer cameraDevice.Close()
-
-	log.Printf("Serving images on [%s/stream]", port)
-	http.HandleFunc("/stream", imageServ)
-	http.HandleFunc("/videos", listVideosHandler)
-	http.HandleFunc("/download/", downloadHandler)
 
+	if err := startDash(); err != nil {
+		fatal("failed to start DASH stream", "error", err)
+	}
+	if err := startSinks(); err != nil {
+		fatal("invalid sink", "error", err)
+	}
 	go frameBroadcaster()
-	// go func() {
-	// 	log.Println("Starting pprof server on :6060")
-	// 	log.Println(http.ListenAndServe(":6060", nil))
-	// }()
+	go httpBroadcaster()
+	go recordingWriter()
+	go continuityMonitor()
+	onDiskLow = restartRecordingForDisk
+	go diskMonitor()
+	go memoryMonitor()
+	go viewerMonitor()
+	go fpsMonitor()
+	go dayNightMonitor()
+	onLoadChange = restartRecordingForLoad
+	onMotionChange = restartRecordingForMotion
+	go loadMonitor()
+	go failoverMonitor()
+
+	detector, err := newMotionDetector(*motionAlgo, *motionThreshold)
+	if err != nil {
+		fatal("invalid motion detection configuration", "error", err)
+	}
+	if detector != nil {
+		go motionMonitor(detector)
+	}
+	if err := startPprof(port); err != nil {
+		fatal("invalid pprof configuration", "error", err)
+	}
+
+	handler, err := withMiddleware(http.DefaultServeMux)
+	if err != nil {
+		fatal("invalid middleware configuration", "error", err)
+	}
+	srv, err := newServer(port, handler)
+	if err != nil {
+		fatal("invalid TLS configuration", "error", err)
+	}
+	go func() {
+		if err := listenAndServe(srv); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fatal("http server stopped", "error", err)
+		}
+	}()
 
-	log.Fatal(http.ListenAndServe(port, nil))
+	// Let FFmpeg finish the current segment before the camera goes away
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	sig := <-sigs
+	slog.Info("shutting down", "signal", sig)
+	srv.Close()
+	if err := finalizeRecording(time.Duration(*shutdownFFmpegTimeout) * time.Second); err != nil {
+		slog.Error("failed to finalize recording", "error", err)
+	}
+	stopSinks(time.Duration(*shutdownFFmpegTimeout) * time.Second)
+	closeCamera()
 }
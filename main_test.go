@@ -0,0 +1,161 @@
+//go:build !recorder
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+	"time"
+
+	"github.com/vladimirvivien/go4vl/v4l2"
+)
+
+// FakeCamera stands in for *device.Device, delivering the frames sent on its
+// output channel.
+type FakeCamera struct {
+	frames chan []byte
+}
+
+func newFakeCamera() *FakeCamera {
+	return &FakeCamera{frames: make(chan []byte)}
+}
+
+func (c *FakeCamera) GetOutput() <-chan []byte {
+	return c.frames
+}
+
+func (c *FakeCamera) GetPixFormat() (v4l2.PixFormat, error) {
+	return v4l2.PixFormat{}, errors.New("fake camera has no pixel format")
+}
+
+func (c *FakeCamera) Close() error {
+	close(c.frames)
+	return nil
+}
+
+// testJPEG returns a small JPEG image filled with gray level v, so frames with
+// different v are not duplicates.
+func testJPEG(t *testing.T, v uint8) []byte {
+	t.Helper()
+	img := image.NewGray(image.Rect(0, 0, 16, 16))
+	for i := range img.Pix {
+		img.Pix[i] = v
+	}
+	img.Set(0, 0, color.Gray{Y: v ^ 0xff})
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// receiveFrame waits for the next frame on ch.
+func receiveFrame(t *testing.T, ch ClientChan) []byte {
+	t.Helper()
+	select {
+	case frame := <-ch:
+		return frame
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for frame")
+		return nil
+	}
+}
+
+func TestBroadcastCamera(t *testing.T) {
+	*warmupFrames = 0
+	clientCapacity.Store(1)
+
+	frame1, frame2, frame3 := testJPEG(t, 10), testJPEG(t, 120), testJPEG(t, 240)
+	tests := []struct {
+		name   string
+		frames [][]byte
+		want   [][]byte // Frames every reading client receives
+		fast   int      // Clients reading every frame
+		slow   int      // Clients that never read
+	}{
+		{
+			name:   "empty frames are dropped",
+			frames: [][]byte{{}, frame1, nil, frame2},
+			want:   [][]byte{frame1, frame2},
+			fast:   1,
+		},
+		{
+			name:   "frames reach all clients",
+			frames: [][]byte{frame1, frame2, frame3},
+			want:   [][]byte{frame1, frame2, frame3},
+			fast:   5,
+		},
+		{
+			name:   "slow clients do not block others",
+			frames: [][]byte{frame1, frame2, frame3, frame1, frame2, frame3},
+			want:   [][]byte{frame1, frame2, frame3, frame1, frame2, frame3},
+			fast:   2,
+			slow:   3,
+		},
+		{
+			name: "no frames",
+			fast: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientShards = nil
+			startBroadcastShards(2)
+
+			var fast []ClientChan
+			for range tt.fast {
+				shard, client, ch := addClient(clientInfo{}, nil)
+				defer shard.removeClient(client)
+				fast = append(fast, ch)
+			}
+			for range tt.slow {
+				shard, client, _ := addClient(clientInfo{}, nil)
+				defer shard.removeClient(client)
+			}
+
+			camera := newFakeCamera()
+			done := make(chan struct{})
+			go func() {
+				broadcastCamera(camera)
+				close(done)
+			}()
+
+			// Frames are sent one at a time and awaited on every fast client, so
+			// none are dropped by a busy shard
+			want := tt.want
+			for _, frame := range tt.frames {
+				camera.frames <- frame
+				if len(frame) == 0 {
+					continue
+				}
+				for i, ch := range fast {
+					if got := receiveFrame(t, ch); !bytes.Equal(got, want[0]) {
+						t.Errorf("client %d got frame of %d bytes, want %d", i, len(got), len(want[0]))
+					}
+				}
+				want = want[1:]
+			}
+			if len(want) > 0 {
+				t.Errorf("%d frames were never delivered", len(want))
+			}
+
+			camera.Close()
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				t.Fatal("broadcastCamera did not return after the camera output closed")
+			}
+			for i, ch := range fast {
+				select {
+				case frame := <-ch:
+					t.Errorf("client %d got unexpected frame of %d bytes", i, len(frame))
+				default:
+				}
+			}
+		})
+	}
+}
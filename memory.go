@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log/slog"
+	"net/http"
+	"runtime"
+	"time"
+)
+
+var maxHeapMB = flag.Int("max-heap-mb", 0, "force a GC and warn when the in-use heap exceeds this many MB (0 disables)")
+
+const memoryInterval = 30 * time.Second
+
+// memoryStats is the subset of runtime.MemStats served at /api/system/memory.
+type memoryStats struct {
+	AllocBytes     uint64    `json:"alloc_bytes"`
+	SysBytes       uint64    `json:"sys_bytes"`
+	HeapInuseBytes uint64    `json:"heap_inuse_bytes"`
+	NumGC          uint32    `json:"num_gc"`
+	Goroutines     int       `json:"goroutines"`
+	Timestamp      time.Time `json:"timestamp"`
+}
+
+// readMemoryStats reads the current memory statistics.
+func readMemoryStats() *memoryStats {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return &memoryStats{
+		AllocBytes:     m.Alloc,
+		SysBytes:       m.Sys,
+		HeapInuseBytes: m.HeapInuse,
+		NumGC:          m.NumGC,
+		Goroutines:     runtime.NumGoroutine(),
+		Timestamp:      time.Now(),
+	}
+}
+
+// memoryMonitor logs memory usage every memoryInterval. When the in-use heap
+// exceeds -max-heap-mb it forces a garbage collection, and logs an error if
+// that does not bring it back under the limit.
+func memoryMonitor() {
+	defer logPanic("memoryMonitor")
+
+	limit := uint64(*maxHeapMB) << 20
+	for ; ; time.Sleep(memoryInterval) {
+		stats := readMemoryStats()
+		slog.Info("memory usage", "alloc_bytes", stats.AllocBytes, "sys_bytes", stats.SysBytes,
+			"num_gc", stats.NumGC, "heap_inuse_bytes", stats.HeapInuseBytes)
+
+		if limit == 0 || stats.HeapInuseBytes <= limit {
+			continue
+		}
+		slog.Warn("heap above limit, forcing GC", "heap_inuse_bytes", stats.HeapInuseBytes, "limit_bytes", limit)
+		runtime.GC()
+		if after := readMemoryStats(); after.HeapInuseBytes > limit {
+			slog.Error("heap still above limit after GC, possible goroutine or channel leak",
+				"heap_inuse_bytes", after.HeapInuseBytes, "limit_bytes", limit, "goroutines", after.Goroutines)
+		}
+	}
+}
+
+// memoryHandler serves the current memory statistics.
+func memoryHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(readMemoryStats()); err != nil {
+		slog.Error("failed to encode memory stats", "error", err)
+	}
+}
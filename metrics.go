@@ -0,0 +1,22 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Prometheus metrics served at /metrics.
+var invalidFrames = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "invalid_frame_total",
+	Help: "Camera frames dropped because they are not complete JPEG images.",
+})
+
+var cameraFPS = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+	Name: "camera_fps",
+	Help: "Frames per second received from the camera, as an exponential moving average.",
+}, currentFPS)
+
+var handlerPanics = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "handler_panics_total",
+	Help: "HTTP handler panics recovered and answered with 500 Internal Server Error.",
+})
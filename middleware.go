@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+var (
+	allowCIDR    = flag.String("allow-cidr", "", "comma-separated CIDRs allowed to connect (empty allows all)")
+	denyCIDR     = flag.String("deny-cidr", "", "comma-separated CIDRs refused even if allowed")
+	trustProxy   = flag.Bool("trust-proxy", false, "take the client address from X-Forwarded-For")
+	allowedHosts = flag.String("allowed-hosts", "", "comma-separated Host header values accepted, to stop DNS rebinding (empty allows any)")
+	corsOrigin   = flag.String("cors-origin", "", "comma-separated origins allowed for cross-origin requests, or * for any (empty disables CORS)")
+
+	authUser      = flag.String("auth-user", "", "admin username for HTTP basic auth")
+	authPass      = flag.String("auth-pass", "", "password of -auth-user")
+	authUsersFile = flag.String("auth-users", "", "YAML file of basic auth users and their viewer, operator or admin roles")
+	noAuthSubnets = flag.String("no-auth-subnets", "", "comma-separated CIDRs whose clients skip authentication, e.g. 192.168.1.0/24")
+	adminToken    = flag.String("admin-token", "", "hex token required as \"Authorization: Bearer <token>\" on /api/* and /restart, which then skip basic auth")
+	streamAuth    = flag.String("stream-auth", "basic", "authentication of the routes outside /api/* and /restart: basic (the -auth-user and -auth-users accounts) or none")
+)
+
+// withMiddleware wraps h with the middleware enabled by the command line flags.
+func withMiddleware(h http.Handler) (http.Handler, error) {
+	allow, err := parseCIDRList(*allowCIDR)
+	if err != nil {
+		return nil, fmt.Errorf("-allow-cidr: %w", err)
+	}
+	deny, err := parseCIDRList(*denyCIDR)
+	if err != nil {
+		return nil, fmt.Errorf("-deny-cidr: %w", err)
+	}
+	trusted, err := parseCIDRList(*noAuthSubnets)
+	if err != nil {
+		return nil, fmt.Errorf("-no-auth-subnets: %w", err)
+	}
+	accounts, err := loadAccounts()
+	if err != nil {
+		return nil, fmt.Errorf("-auth-users: %w", err)
+	}
+	// Administrative routes keep basic auth unless -admin-token replaces it,
+	// whatever -stream-auth says about the others
+	public, admin := h, h
+	if len(accounts) > 0 {
+		admin = basicAuth(h, accounts, trusted)
+	}
+	switch *streamAuth {
+	case "basic":
+		public = admin
+	case "none":
+	default:
+		return nil, fmt.Errorf("-stream-auth: unknown mode %q", *streamAuth)
+	}
+	if *adminToken != "" {
+		token, err := hex.DecodeString(*adminToken)
+		if err != nil || len(token) == 0 {
+			return nil, errors.New("-admin-token must be a hex string")
+		}
+		admin = bearerAuth(h, *adminToken)
+	}
+	h = splitAdminAuth(admin, public)
+	if *tlsCA != "" {
+		h = requireClientCert(h)
+	}
+	if *corsOrigin != "" {
+		h = cors(h, strings.Split(*corsOrigin, ","))
+	}
+	if len(allow) > 0 || len(deny) > 0 {
+		h = ipFilter(h, allow, deny)
+	}
+	if *allowedHosts != "" {
+		h = hostFilter(h, strings.Split(*allowedHosts, ","))
+	}
+	return logRequests(recoverPanics(hidePprof(h))), nil
+}
+
+// parseCIDRList parses a comma-separated list of CIDRs.
+func parseCIDRList(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range strings.Split(list, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// clientIP returns the address of the client that made r. With -trust-proxy the
+// last X-Forwarded-For entry, the one added by our proxy, is used instead of the
+// connection address.
+func clientIP(r *http.Request) net.IP {
+	if *trustProxy {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			hops := strings.Split(fwd, ",")
+			if ip := net.ParseIP(strings.TrimSpace(hops[len(hops)-1])); ip != nil {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ipFilter refuses clients that are in deny or, when allow is not empty, not in
+// allow. The deny list takes precedence.
+func ipFilter(next http.Handler, allow, deny []*net.IPNet) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r)
+		if ip == nil || containsIP(deny, ip) || (len(allow) > 0 && !containsIP(allow, ip)) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// hostFilter answers 400 Bad Request unless the Host header is one of hosts.
+// A host without a port matches any port.
+func hostFilter(next http.Handler, hosts []string) http.Handler {
+	allowed := make(map[string]bool, len(hosts))
+	for _, host := range hosts {
+		allowed[strings.ToLower(strings.TrimSpace(host))] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := strings.ToLower(r.Host)
+		name, _, err := net.SplitHostPort(host)
+		if err != nil {
+			name = strings.Trim(host, "[]")
+		}
+		if !allowed[host] && !allowed[name] {
+			slog.Warn("rejected request for unknown host", "host", r.Host, "remote_addr", r.RemoteAddr)
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// loggingResponseWriter records the status code and body size of a response.
+type loggingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *loggingResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *loggingResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer for flushing
+// and write deadlines.
+func (w *loggingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *loggingResponseWriter) Push(target string, opts *http.PushOptions) error {
+	if pusher, ok := w.ResponseWriter.(http.Pusher); ok {
+		return pusher.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
+
+// logRequests logs every request at debug level once its handler returns.
+// For streams that is when the client disconnects.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		lw := &loggingResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(lw, r)
+		if lw.status == 0 {
+			lw.status = http.StatusOK
+		}
+		slog.Debug("request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"remote_addr", r.RemoteAddr,
+			"status", lw.status,
+			"bytes", lw.bytes,
+			"latency", time.Since(start),
+		)
+	})
+}
+
+// recoverPanics answers 500 Internal Server Error when a handler panics and
+// logs the panic with its stack trace, instead of leaving the client with a
+// dropped connection.
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if p := recover(); p != nil {
+				if p == http.ErrAbortHandler {
+					panic(p)
+				}
+				handlerPanics.Inc()
+				slog.Error("panic", "handler", r.URL.Path, "error", p, "stack", string(debug.Stack()))
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// cors adds the CORS response headers for requests from one of origins and
+// answers preflight requests itself.
+func cors(next http.Handler, origins []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		for _, allowed := range origins {
+			allowed = strings.TrimSpace(allowed)
+			if allowed == "*" || allowed == origin {
+				w.Header().Set("Access-Control-Allow-Origin", allowed)
+				if allowed != "*" {
+					w.Header().Add("Vary", "Origin")
+				}
+				w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+				w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+				break
+			}
+		}
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"log/slog"
+	"math"
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	motionAlgo      = flag.String("motion-algo", "none", "motion detection algorithm: none, pixel-diff, frame-hash or optical-flow")
+	motionThreshold = flag.Float64("motion-threshold", 0, "motion score above which motion is reported (0 uses the algorithm's default)")
+	motionInterval  = flag.Duration("motion-interval", 200*time.Millisecond, "minimum time between analyzed frames")
+)
+
+var (
+	motionChan     = make(chan []byte, 1) // Latest frame offered to the motion detector
+	motionDetected atomic.Bool
+)
+
+// onMotionChange, when set, is called after motionDetected changes.
+var onMotionChange func(detected bool)
+
+// MotionDetector decides whether the scene changed between two frames.
+type MotionDetector interface {
+	Detect(prev, curr image.Image) bool
+}
+
+// motionScorer is implemented by detectors that report the score of their last
+// Detect call, normalized to 0..1.
+type motionScorer interface {
+	Score() float64
+}
+
+// newMotionDetector returns the detector for algo, or nil for "none".
+func newMotionDetector(algo string, threshold float64) (MotionDetector, error) {
+	switch algo {
+	case "none", "":
+		return nil, nil
+	case "pixel-diff":
+		return &PixelDiffDetector{Threshold: orDefault(threshold, 0.01)}, nil
+	case "frame-hash":
+		return &FrameHashDetector{Threshold: orDefault(threshold, 0.1)}, nil
+	case "optical-flow":
+		return &OpticalFlowDetector{Threshold: orDefault(threshold, 0.05)}, nil
+	default:
+		return nil, fmt.Errorf("unknown motion algorithm %q", algo)
+	}
+}
+
+func orDefault(v, def float64) float64 {
+	if v > 0 {
+		return v
+	}
+	return def
+}
+
+// offerMotionFrame hands frame to the motion detector without blocking. The
+// detector only ever sees the most recent frame.
+func offerMotionFrame(frame []byte) {
+	select {
+	case motionChan <- frame:
+	default:
+	}
+}
+
+// motionMonitor decodes frames from motionChan at most once per -motion-interval
+// and updates motionDetected, publishing an event when motion starts or stops.
+func motionMonitor(detector MotionDetector) {
+	defer logPanic("motionMonitor")
+
+	var prev image.Image
+	var last time.Time
+	for frame := range motionChan {
+		if time.Since(last) < *motionInterval {
+			continue
+		}
+		last = time.Now()
+
+		curr, err := jpeg.Decode(bytes.NewReader(frame))
+		if err != nil {
+			slog.Debug("motion detector skipped undecodable frame", "error", err)
+			continue
+		}
+		curr = maskExclusions(curr)
+		if prev == nil {
+			prev = curr
+			continue
+		}
+
+		detected := detector.Detect(prev, curr)
+		prev = curr
+		if motionDetected.Swap(detected) == detected {
+			continue
+		}
+		if onMotionChange != nil {
+			onMotionChange(detected)
+		}
+
+		var score float64
+		if s, ok := detector.(motionScorer); ok {
+			score = s.Score()
+		}
+		if detected {
+			slog.Info("motion detected", "algo", *motionAlgo, "score", score)
+			notifyWebhook(map[string]any{
+				"event":     "motion",
+				"timestamp": time.Now().Format(time.RFC3339),
+				"score":     score,
+			})
+		} else {
+			slog.Info("motion stopped", "algo", *motionAlgo)
+		}
+		publishEvent("motion", map[string]any{
+			"detected":  detected,
+			"score":     score,
+			"timestamp": time.Now().Format(time.RFC3339),
+		})
+	}
+}
+
+// grayDownscale box-filters img down to a w×h grayscale image. JPEG frames
+// decode to YCbCr, whose luma plane is used directly.
+func grayDownscale(img image.Image, w, h int) *image.Gray {
+	out := image.NewGray(image.Rect(0, 0, w, h))
+	b := img.Bounds()
+	ycc, isYCbCr := img.(*image.YCbCr)
+	for y := 0; y < h; y++ {
+		y0 := b.Min.Y + y*b.Dy()/h
+		y1 := max(b.Min.Y+(y+1)*b.Dy()/h, y0+1)
+		for x := 0; x < w; x++ {
+			x0 := b.Min.X + x*b.Dx()/w
+			x1 := max(b.Min.X+(x+1)*b.Dx()/w, x0+1)
+			var sum, n int
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					if isYCbCr {
+						sum += int(ycc.Y[ycc.YOffset(sx, sy)])
+					} else {
+						sum += int(color.GrayModel.Convert(img.At(sx, sy)).(color.Gray).Y)
+					}
+					n++
+				}
+			}
+			out.Pix[y*out.Stride+x] = uint8(sum / n)
+		}
+	}
+	return out
+}
+
+// pixelNoiseFloor is the absolute luma difference below which a pixel is
+// considered sensor noise rather than change.
+const pixelNoiseFloor = 25
+
+// PixelDiffDetector compares downscaled frames pixel by pixel and reports motion
+// when the fraction of pixels whose absolute difference is above the noise floor
+// exceeds Threshold.
+type PixelDiffDetector struct {
+	Threshold float64
+	score     float64
+}
+
+func (d *PixelDiffDetector) Detect(prev, curr image.Image) bool {
+	a, b := grayDownscale(prev, 160, 90), grayDownscale(curr, 160, 90)
+	var changed int
+	for i := range a.Pix {
+		diff := int(a.Pix[i]) - int(b.Pix[i])
+		if diff > pixelNoiseFloor || diff < -pixelNoiseFloor {
+			changed++
+		}
+	}
+	d.score = float64(changed) / float64(len(a.Pix))
+	return d.score > d.Threshold
+}
+
+func (d *PixelDiffDetector) Score() float64 { return d.score }
+
+// FrameHashDetector compares 64-bit difference hashes of the frames and reports
+// motion when the fraction of differing bits exceeds Threshold.
+type FrameHashDetector struct {
+	Threshold float64
+	score     float64
+}
+
+func (d *FrameHashDetector) Detect(prev, curr image.Image) bool {
+	d.score = float64(bits.OnesCount64(dHash(prev)^dHash(curr))) / 64
+	return d.score > d.Threshold
+}
+
+func (d *FrameHashDetector) Score() float64 { return d.score }
+
+// dHash sets one bit per pixel of a 9×8 thumbnail that is brighter than its
+// right-hand neighbour.
+func dHash(img image.Image) uint64 {
+	g := grayDownscale(img, 9, 8)
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if g.Pix[y*g.Stride+x] > g.Pix[y*g.Stride+x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// OpticalFlowDetector estimates Lucas-Kanade optical flow on a grid of windows
+// over downscaled frames. Motion is reported when the fraction of windows that
+// moved exceeds Threshold. Both frames are normalized to their mean brightness
+// first, so global lighting changes produce little flow.
+type OpticalFlowDetector struct {
+	Threshold float64
+	score     float64
+	dx, dy    float64 // Mean flow of the moving windows in the last Detect call
+}
+
+const (
+	flowWidth    = 80
+	flowHeight   = 45
+	flowWindow   = 2   // Window half-size in pixels
+	flowMinShift = 0.5 // Flow magnitude that counts as movement, in pixels
+)
+
+func (d *OpticalFlowDetector) Detect(prev, curr image.Image) bool {
+	a := normalizedLuma(grayDownscale(prev, flowWidth, flowHeight))
+	b := normalizedLuma(grayDownscale(curr, flowWidth, flowHeight))
+	at := func(p []float64, x, y int) float64 { return p[y*flowWidth+x] }
+
+	var windows, moving int
+	var sumDx, sumDy float64
+	for cy := flowWindow + 1; cy < flowHeight-flowWindow-1; cy += 2*flowWindow + 1 {
+		for cx := flowWindow + 1; cx < flowWidth-flowWindow-1; cx += 2*flowWindow + 1 {
+			var sxx, sxy, syy, sxt, syt float64
+			for y := cy - flowWindow; y <= cy+flowWindow; y++ {
+				for x := cx - flowWindow; x <= cx+flowWindow; x++ {
+					ix := (at(a, x+1, y) - at(a, x-1, y)) / 2
+					iy := (at(a, x, y+1) - at(a, x, y-1)) / 2
+					it := at(b, x, y) - at(a, x, y)
+					sxx += ix * ix
+					sxy += ix * iy
+					syy += iy * iy
+					sxt += ix * it
+					syt += iy * it
+				}
+			}
+			windows++
+
+			// Skip windows without enough texture to solve for flow
+			det := sxx*syy - sxy*sxy
+			if det < 1e-6 {
+				continue
+			}
+			u := (-syy*sxt + sxy*syt) / det
+			v := (sxy*sxt - sxx*syt) / det
+			if math.Hypot(u, v) > flowMinShift {
+				moving++
+				sumDx += u
+				sumDy += v
+			}
+		}
+	}
+
+	d.score, d.dx, d.dy = 0, 0, 0
+	if windows > 0 {
+		d.score = float64(moving) / float64(windows)
+	}
+	if moving > 0 {
+		d.dx, d.dy = sumDx/float64(moving), sumDy/float64(moving)
+	}
+	return d.score > d.Threshold
+}
+
+func (d *OpticalFlowDetector) Score() float64 { return d.score }
+
+// Direction returns the mean flow vector, in downscaled pixels, of the windows
+// that moved in the last Detect call.
+func (d *OpticalFlowDetector) Direction() (dx, dy float64) { return d.dx, d.dy }
+
+// normalizedLuma returns g's pixels scaled to 0..1 with the mean brightness
+// subtracted.
+func normalizedLuma(g *image.Gray) []float64 {
+	out := make([]float64, len(g.Pix))
+	var sum float64
+	for i, p := range g.Pix {
+		out[i] = float64(p) / 255
+		sum += out[i]
+	}
+	mean := sum / float64(len(out))
+	for i := range out {
+		out[i] -= mean
+	}
+	return out
+}
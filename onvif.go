@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+var onvifEnabled = flag.Bool("onvif", false, "answer ONVIF WS-Discovery probes and serve the minimal ONVIF device and media services")
+
+const wsDiscoveryAddr = "239.255.255.250:3702"
+
+// onvifActions are the SOAP requests we answer, checked in order against the request body.
+var onvifActions = []string{"GetCapabilities", "GetDeviceInformation", "GetStreamUri", "GetSnapshotUri"}
+
+var messageIDPattern = regexp.MustCompile(`<(?:\w+:)?MessageID[^>]*>([^<]+)<`)
+
+// startONVIF registers the ONVIF SOAP endpoints and starts the WS-Discovery
+// responder advertising them on port.
+func startONVIF(port string) {
+	http.HandleFunc("POST /onvif/device_service", onvifHandler)
+	http.HandleFunc("POST /onvif/media_service", onvifHandler)
+	go wsDiscoveryResponder(port)
+}
+
+// onvifHandler answers the SOAP request in the body. Only the calls NVR
+// software needs to find the stream are implemented.
+func onvifHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 64*1024))
+	if err != nil {
+		http.Error(w, "Unable to read request", http.StatusBadRequest)
+		return
+	}
+
+	action := ""
+	for _, a := range onvifActions {
+		if strings.Contains(string(body), a) {
+			action = a
+			break
+		}
+	}
+
+	base := "http://" + r.Host
+	var response string
+	switch action {
+	case "GetCapabilities":
+		response = fmt.Sprintf(`<tds:GetCapabilitiesResponse><tds:Capabilities>`+
+			`<tt:Device><tt:XAddr>%[1]s/onvif/device_service</tt:XAddr></tt:Device>`+
+			`<tt:Media><tt:XAddr>%[1]s/onvif/media_service</tt:XAddr></tt:Media>`+
+			`</tds:Capabilities></tds:GetCapabilitiesResponse>`, xmlEscape(base))
+	case "GetDeviceInformation":
+		response = fmt.Sprintf(`<tds:GetDeviceInformationResponse>`+
+			`<tds:Manufacturer>Raspberry Pi</tds:Manufacturer><tds:Model>%s</tds:Model>`+
+			`<tds:FirmwareVersion>1.0</tds:FirmwareVersion><tds:SerialNumber>%s</tds:SerialNumber>`+
+			`<tds:HardwareId>%s</tds:HardwareId></tds:GetDeviceInformationResponse>`,
+			xmlEscape(*cameraName), onvifUUID, xmlEscape(devName))
+	case "GetStreamUri":
+		response = fmt.Sprintf(`<trt:GetStreamUriResponse><trt:MediaUri><tt:Uri>%s/stream</tt:Uri>`+
+			`<tt:InvalidAfterConnect>false</tt:InvalidAfterConnect><tt:InvalidAfterReboot>false</tt:InvalidAfterReboot>`+
+			`<tt:Timeout>PT0S</tt:Timeout></trt:MediaUri></trt:GetStreamUriResponse>`, xmlEscape(base))
+	case "GetSnapshotUri":
+		response = fmt.Sprintf(`<trt:GetSnapshotUriResponse><trt:MediaUri><tt:Uri>%s/snapshot</tt:Uri>`+
+			`<tt:InvalidAfterConnect>false</tt:InvalidAfterConnect><tt:InvalidAfterReboot>false</tt:InvalidAfterReboot>`+
+			`<tt:Timeout>PT0S</tt:Timeout></trt:MediaUri></trt:GetSnapshotUriResponse>`, xmlEscape(base))
+	default:
+		w.Header().Set("Content-Type", "application/soap+xml; charset=utf-8")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, soapEnvelope(`<s:Fault><s:Code><s:Value>s:Sender</s:Value></s:Code>`+
+			`<s:Reason><s:Text xml:lang="en">Action not supported</s:Text></s:Reason></s:Fault>`))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/soap+xml; charset=utf-8")
+	fmt.Fprint(w, soapEnvelope(response))
+}
+
+func soapEnvelope(body string) string {
+	return xml.Header + `<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope"` +
+		` xmlns:tds="http://www.onvif.org/ver10/device/wsdl"` +
+		` xmlns:trt="http://www.onvif.org/ver10/media/wsdl"` +
+		` xmlns:tt="http://www.onvif.org/ver10/schema">` +
+		`<s:Body>` + body + `</s:Body></s:Envelope>`
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// onvifUUID identifies this camera in WS-Discovery for the life of the process.
+var onvifUUID = newUUID()
+
+func newUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// wsDiscoveryResponder answers WS-Discovery probes on the multicast group with
+// the address of our device service.
+func wsDiscoveryResponder(port string) {
+	defer logPanic("wsDiscoveryResponder")
+
+	group, err := net.ResolveUDPAddr("udp4", wsDiscoveryAddr)
+	if err != nil {
+		slog.Error("failed to resolve WS-Discovery address", "error", err)
+		return
+	}
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		slog.Error("failed to join WS-Discovery group", "error", err)
+		return
+	}
+	defer conn.Close()
+	slog.Info("ONVIF discovery enabled", "group", wsDiscoveryAddr)
+
+	_, httpPort, err := net.SplitHostPort(port)
+	if err != nil {
+		slog.Error("invalid port for WS-Discovery", "port", port, "error", err)
+		return
+	}
+
+	buf := make([]byte, 8192)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			slog.Error("WS-Discovery read failed", "error", err)
+			return
+		}
+		probe := string(buf[:n])
+		if !strings.Contains(probe, "Probe") || strings.Contains(probe, "ProbeMatches") {
+			continue
+		}
+
+		relatesTo := ""
+		if m := messageIDPattern.FindStringSubmatch(probe); m != nil {
+			relatesTo = m[1]
+		}
+		ip, err := localIPFor(from)
+		if err != nil {
+			slog.Warn("failed to find local address for WS-Discovery reply", "to", from, "error", err)
+			continue
+		}
+		xaddr := fmt.Sprintf("http://%s/onvif/device_service", net.JoinHostPort(ip.String(), httpPort))
+		if _, err := conn.WriteToUDP([]byte(probeMatches(relatesTo, xaddr)), from); err != nil {
+			slog.Warn("failed to answer WS-Discovery probe", "to", from, "error", err)
+		}
+	}
+}
+
+// localIPFor returns the local address used to reach addr.
+func localIPFor(addr *net.UDPAddr) (net.IP, error) {
+	conn, err := net.DialUDP("udp4", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+func probeMatches(relatesTo, xaddr string) string {
+	return xml.Header + `<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope"` +
+		` xmlns:a="http://schemas.xmlsoap.org/ws/2004/08/addressing"` +
+		` xmlns:d="http://schemas.xmlsoap.org/ws/2005/04/discovery"` +
+		` xmlns:dn="http://www.onvif.org/ver10/network/wsdl">` +
+		`<s:Header>` +
+		`<a:MessageID>urn:uuid:` + newUUID() + `</a:MessageID>` +
+		`<a:RelatesTo>` + xmlEscape(relatesTo) + `</a:RelatesTo>` +
+		`<a:To>http://schemas.xmlsoap.org/ws/2004/08/addressing/role/anonymous</a:To>` +
+		`<a:Action>http://schemas.xmlsoap.org/ws/2005/04/discovery/ProbeMatches</a:Action>` +
+		`</s:Header><s:Body><d:ProbeMatches><d:ProbeMatch>` +
+		`<a:EndpointReference><a:Address>urn:uuid:` + onvifUUID + `</a:Address></a:EndpointReference>` +
+		`<d:Types>dn:NetworkVideoTransmitter</d:Types>` +
+		`<d:Scopes>onvif://www.onvif.org/type/video_encoder onvif://www.onvif.org/name/` + xmlEscape(strings.ReplaceAll(*cameraName, " ", "_")) + `</d:Scopes>` +
+		`<d:XAddrs>` + xmlEscape(xaddr) + `</d:XAddrs>` +
+		`<d:MetadataVersion>1</d:MetadataVersion>` +
+		`</d:ProbeMatch></d:ProbeMatches></s:Body></s:Envelope>`
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const playbackTokenTTL = 5 * time.Minute
+
+// playbackToken grants a single playback of a clip.
+type playbackToken struct {
+	clip    string
+	expires time.Time
+}
+
+var (
+	playbackTokens      = make(map[string]playbackToken)
+	playbackTokensMutex sync.Mutex
+)
+
+// playbackTokenHandler issues a single-use token for the clip named in a
+// /api/clips/{filename}/playback-token path. The clip name may contain slashes,
+// for clips in date subdirectories, so it is matched with a trailing wildcard
+// and the /playback-token suffix is checked here. The token is opaque so the
+// play URL does not reveal the clip name.
+func playbackTokenHandler(w http.ResponseWriter, r *http.Request) {
+	clip, ok := strings.CutSuffix(r.PathValue("filename"), "/playback-token")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if clip == "" {
+		http.Error(w, "Missing clip name", http.StatusBadRequest)
+		return
+	}
+
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		http.Error(w, "Unable to generate token", http.StatusInternalServerError)
+		return
+	}
+	token := hex.EncodeToString(buf)
+	expires := time.Now().Add(playbackTokenTTL)
+
+	playbackTokensMutex.Lock()
+	for t, pt := range playbackTokens {
+		if time.Now().After(pt.expires) {
+			delete(playbackTokens, t)
+		}
+	}
+	playbackTokens[token] = playbackToken{clip: clip, expires: expires}
+	playbackTokensMutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(map[string]any{
+		"token":      token,
+		"url":        "/play/" + token,
+		"expires_at": expires.Format(time.RFC3339),
+	})
+	if err != nil {
+		slog.Error("failed to encode playback token", "error", err)
+	}
+}
+
+const (
+	minPlaybackSpeed = 0.25
+	maxPlaybackSpeed = 4.0
+)
+
+// playHandler serves the clip a playback token was issued for. The token is
+// invalidated before the clip is served so it cannot be reused. With ?speed=N
+// the clip is re-encoded on the fly to play N times faster.
+func playHandler(w http.ResponseWriter, r *http.Request) {
+	speed := 1.0
+	if s := r.URL.Query().Get("speed"); s != "" {
+		var err error
+		speed, err = strconv.ParseFloat(s, 64)
+		if err != nil || speed < minPlaybackSpeed || speed > maxPlaybackSpeed {
+			http.Error(w, fmt.Sprintf("speed must be between %g and %g", minPlaybackSpeed, maxPlaybackSpeed), http.StatusBadRequest)
+			return
+		}
+	}
+
+	pt, ok := redeemPlaybackToken(r.PathValue("name"))
+	if !ok {
+		http.Error(w, "Invalid or expired playback token", http.StatusForbidden)
+		return
+	}
+	clip := pt.clip
+
+	if speed == 1 {
+		serveClip(w, r, clip)
+		return
+	}
+	streamClipAtSpeed(w, r, clip, speed)
+}
+
+// redeemPlaybackToken removes token and returns it if it was valid.
+func redeemPlaybackToken(token string) (playbackToken, bool) {
+	playbackTokensMutex.Lock()
+	pt, ok := playbackTokens[token]
+	delete(playbackTokens, token)
+	playbackTokensMutex.Unlock()
+
+	if !ok || time.Now().After(pt.expires) {
+		return playbackToken{}, false
+	}
+	return pt, true
+}
+
+// streamClipAtSpeed pipes the clip through FFmpeg to change its playback speed
+// and streams the result to the client. FFmpeg is killed if the client goes away.
+func streamClipAtSpeed(w http.ResponseWriter, r *http.Request, name string, speed float64) {
+	clip, err := clipStore.Read(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		http.NotFound(w, r)
+		return
+	}
+	if errors.Is(err, errInvalidClipName) {
+		http.Error(w, "Invalid clip name", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Unable to read file", http.StatusInternalServerError)
+		return
+	}
+	defer clip.Close()
+
+	cmd := exec.CommandContext(r.Context(),
+		*ffmpegPath,
+		"-hide_banner",
+		"-loglevel", "error",
+		"-i", "pipe:0",
+		"-filter:v", fmt.Sprintf("setpts=%s*PTS", strconv.FormatFloat(1/speed, 'f', -1, 64)),
+		"-an",
+		"-c:v", "libx264",
+		"-preset", "veryfast",
+		"-f", "matroska",
+		"pipe:1",
+	)
+	cmd.Stdin = clip
+	cmd.Stdout = longResponse(w)
+
+	w.Header().Set("Content-Type", "video/x-matroska")
+	if err := cmd.Run(); err != nil && r.Context().Err() == nil {
+		slog.Error("speed playback failed", "clip", name, "speed", speed, "error", err)
+	}
+}
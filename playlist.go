@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// playlistEntry is a clip in a playlist. Seconds is -1 when the duration is
+// not known.
+type playlistEntry struct {
+	Name    string
+	URL     string
+	Seconds float64
+}
+
+// playlistEntries returns all clips in the -container format sorted by
+// modification time. Durations run from the timestamp in the clip name to its
+// last modification, as in the continuity report.
+func playlistEntries() ([]playlistEntry, error) {
+	clips, err := clipStore.List()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(clips, func(i, j int) bool { return clips[i].ModTime.Before(clips[j].ModTime) })
+
+	var entries []playlistEntry
+	for _, clip := range clips {
+		if filepath.Ext(clip.Name) != clipExt() {
+			continue
+		}
+		entry := playlistEntry{
+			Name:    clip.Name,
+			URL:     (&url.URL{Path: "/download/" + clip.Name}).EscapedPath(),
+			Seconds: -1,
+		}
+		if stamp := clipTimePattern.FindString(clip.Name); stamp != "" {
+			start, err := time.ParseInLocation("20060102T150405", stamp, time.Local)
+			if err == nil && !clip.ModTime.Before(start) {
+				entry.Seconds = clip.ModTime.Sub(start).Seconds()
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// playlistHandler serves all clips as an M3U playlist so players like VLC or
+// MPV can play through them in order.
+func playlistHandler(w http.ResponseWriter, r *http.Request) {
+	entries, err := playlistEntries()
+	if err != nil {
+		slog.Error("failed to list clips for playlist", "error", err)
+		http.Error(w, "Unable to list clips", http.StatusInternalServerError)
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	for _, e := range entries {
+		fmt.Fprintf(&b, "#EXTINF:%d,%s\n%s\n", int(math.Round(e.Seconds)), path.Base(e.Name), e.URL)
+	}
+
+	w.Header().Set("Content-Type", "audio/x-mpegurl")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write([]byte(b.String()))
+}
+
+// hlsPlaylistHandler serves all clips as a finished HLS media playlist. Clips
+// of unknown duration are skipped since HLS requires one.
+func hlsPlaylistHandler(w http.ResponseWriter, r *http.Request) {
+	entries, err := playlistEntries()
+	if err != nil {
+		slog.Error("failed to list clips for playlist", "error", err)
+		http.Error(w, "Unable to list clips", http.StatusInternalServerError)
+		return
+	}
+
+	var body strings.Builder
+	target := 1
+	for _, e := range entries {
+		if e.Seconds < 0 {
+			continue
+		}
+		target = max(target, int(math.Ceil(e.Seconds)))
+		fmt.Fprintf(&body, "#EXTINF:%.3f,%s\n%s\n", e.Seconds, path.Base(e.Name), e.URL)
+	}
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-PLAYLIST-TYPE:VOD\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:0\n", target)
+	b.WriteString(body.String())
+	b.WriteString("#EXT-X-ENDLIST\n")
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write([]byte(b.String()))
+}
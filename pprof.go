@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/subtle"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+)
+
+var (
+	pprofAddr  = flag.String("pprof-addr", "", "address for the pprof debug server, e.g. :6060 (empty disables)")
+	pprofToken = flag.String("pprof-token", "", "bearer token required for /debug/pprof/ (empty requires none)")
+)
+
+// startPprof serves the profiling endpoints on -pprof-addr, which must use a
+// different port than the main server on mainAddr. It does nothing if
+// -pprof-addr is empty.
+func startPprof(mainAddr string) error {
+	if *pprofAddr == "" {
+		return nil
+	}
+	_, pprofPort, err := net.SplitHostPort(*pprofAddr)
+	if err != nil {
+		return fmt.Errorf("-pprof-addr: %w", err)
+	}
+	if _, mainPort, err := net.SplitHostPort(mainAddr); err == nil && mainPort == pprofPort {
+		return fmt.Errorf("-pprof-addr port %s is the same as the main port", pprofPort)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	go func() {
+		slog.Info("starting pprof server", "addr", *pprofAddr)
+		if err := http.ListenAndServe(*pprofAddr, recoverPanics(requirePprofToken(mux))); err != nil {
+			slog.Error("pprof server stopped", "error", err)
+		}
+	}()
+	return nil
+}
+
+// requirePprofToken answers 401 Unauthorized unless the request carries
+// -pprof-token as its bearer token.
+func requirePprofToken(next http.Handler) http.Handler {
+	if *pprofToken == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(*pprofToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// hidePprof answers 404 Not Found for the profiling endpoints that importing
+// net/http/pprof registers on the default mux, so they are only reachable
+// through -pprof-addr.
+func hidePprof(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/debug/pprof") {
+			http.NotFound(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"log/slog"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// processedJPEGQuality is the quality frames are re-encoded at after processing.
+const processedJPEGQuality = 90
+
+// FrameProcessor transforms a single MJPEG frame.
+type FrameProcessor interface {
+	Process(frame []byte) ([]byte, error)
+}
+
+// processorChain is applied to every camera frame before it is streamed or recorded.
+var processorChain []FrameProcessor
+
+// frameProcessors maps the names accepted by -processor to constructors.
+var frameProcessors = map[string]func() FrameProcessor{
+	"grayscale": func() FrameProcessor { return GrayscaleProcessor{} },
+	"flip-h":    func() FrameProcessor { return imageProcessor(flipHorizontal) },
+	"blur":      func() FrameProcessor { return imageProcessor(boxBlur) },
+	"timestamp": func() FrameProcessor { return imageProcessor(drawTimestamp) },
+	"exif-time": func() FrameProcessor { return ExifTimeProcessor{} },
+}
+
+// newProcessorChain builds the processors named in the comma-separated list.
+func newProcessorChain(list string) ([]FrameProcessor, error) {
+	var chain []FrameProcessor
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		newProcessor, ok := frameProcessors[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown frame processor %q", name)
+		}
+		chain = append(chain, newProcessor())
+	}
+	// A position is only written along with the Exif timestamp
+	if gpsEnabled() && !slices.Contains(chain, FrameProcessor(ExifTimeProcessor{})) {
+		chain = append(chain, ExifTimeProcessor{})
+	}
+	return chain, nil
+}
+
+// processFrame runs frame through each processor of chain in order.
+func processFrame(chain []FrameProcessor, frame []byte) ([]byte, error) {
+	for _, p := range chain {
+		var err error
+		if frame, err = p.Process(frame); err != nil {
+			return nil, err
+		}
+	}
+	return frame, nil
+}
+
+// applyProcessors runs frame through processorChain. The original frame is
+// returned if a processor fails, so a bad frame never stalls the stream.
+func applyProcessors(frame []byte) []byte {
+	if len(processorChain) == 0 {
+		return frame
+	}
+	processed, err := processFrame(processorChain, frame)
+	if err != nil {
+		slog.Debug("frame processing failed, using original frame", "error", err)
+		return frame
+	}
+	return processed
+}
+
+// streamProcessors returns the per-client processors requested by the query
+// parameters of a /stream or /snapshot request: ?filter=gray, resizing with
+// ?width= or ?scale=, then re-encoding with ?quality=.
+func streamProcessors(query url.Values) ([]FrameProcessor, error) {
+	var chain []FrameProcessor
+	switch filter := query.Get("filter"); filter {
+	case "":
+	case "gray":
+		chain = append(chain, GrayscaleProcessor{})
+	default:
+		return nil, fmt.Errorf("unknown filter %q", filter)
+	}
+	resizer, err := newResizeProcessor(query)
+	if err != nil {
+		return nil, err
+	}
+	if resizer != nil {
+		chain = append(chain, resizer)
+	}
+	if q := query.Get("quality"); q != "" {
+		quality, err := strconv.Atoi(q)
+		if err != nil || quality < 1 || quality > 95 {
+			return nil, errors.New("quality must be between 1 and 95")
+		}
+		chain = append(chain, QualityProcessor{Quality: quality})
+	}
+	return chain, nil
+}
+
+// QualityProcessor re-encodes frames at a fixed JPEG quality.
+type QualityProcessor struct {
+	Quality int
+}
+
+func (p QualityProcessor) Process(frame []byte) ([]byte, error) {
+	img, err := jpeg.Decode(bytes.NewReader(frame))
+	if err != nil {
+		return nil, fmt.Errorf("decode frame: %w", err)
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: p.Quality}); err != nil {
+		return nil, fmt.Errorf("encode frame: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// imageProcessor adapts a function working on decoded images to a FrameProcessor.
+type imageProcessor func(img *image.RGBA) *image.RGBA
+
+func (f imageProcessor) Process(frame []byte) ([]byte, error) {
+	src, err := jpeg.Decode(bytes.NewReader(frame))
+	if err != nil {
+		return nil, fmt.Errorf("decode frame: %w", err)
+	}
+	img := image.NewRGBA(src.Bounds())
+	draw.Draw(img, img.Bounds(), src, src.Bounds().Min, draw.Src)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, f(img), &jpeg.Options{Quality: processedQuality()}); err != nil {
+		return nil, fmt.Errorf("encode frame: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// GrayscaleProcessor re-encodes frames as single-channel grayscale JPEGs,
+// which are considerably smaller than color ones.
+type GrayscaleProcessor struct{}
+
+func (GrayscaleProcessor) Process(frame []byte) ([]byte, error) {
+	src, err := jpeg.Decode(bytes.NewReader(frame))
+	if err != nil {
+		return nil, fmt.Errorf("decode frame: %w", err)
+	}
+	gray := image.NewGray(src.Bounds())
+	draw.Draw(gray, gray.Bounds(), src, src.Bounds().Min, draw.Src)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, gray, &jpeg.Options{Quality: processedQuality()}); err != nil {
+		return nil, fmt.Errorf("encode frame: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func flipHorizontal(img *image.RGBA) *image.RGBA {
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row := img.Pix[img.PixOffset(b.Min.X, y):img.PixOffset(b.Max.X, y)]
+		for l, r := 0, len(row)-4; l < r; l, r = l+4, r-4 {
+			for c := 0; c < 4; c++ {
+				row[l+c], row[r+c] = row[r+c], row[l+c]
+			}
+		}
+	}
+	return img
+}
+
+// boxBlur averages each pixel with its neighbours within blurRadius.
+func boxBlur(img *image.RGBA) *image.RGBA {
+	const blurRadius = 2
+	b := img.Bounds()
+	out := image.NewRGBA(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			var r, g, bl, n uint32
+			for dy := -blurRadius; dy <= blurRadius; dy++ {
+				for dx := -blurRadius; dx <= blurRadius; dx++ {
+					p := image.Pt(x+dx, y+dy)
+					if !p.In(b) {
+						continue
+					}
+					c := img.RGBAAt(p.X, p.Y)
+					r, g, bl, n = r+uint32(c.R), g+uint32(c.G), bl+uint32(c.B), n+1
+				}
+			}
+			out.SetRGBA(x, y, color.RGBA{uint8(r / n), uint8(g / n), uint8(bl / n), 255})
+		}
+	}
+	return out
+}
+
+// drawTimestamp writes the camera name and local time in the top left corner.
+// Recordings get their timestamp from FFmpeg's drawtext filter instead.
+func drawTimestamp(img *image.RGBA) *image.RGBA {
+	d := &font.Drawer{
+		Dst:  img,
+		Src:  image.White,
+		Face: basicfont.Face7x13,
+		Dot:  fixed.P(img.Bounds().Min.X+10, img.Bounds().Min.Y+10+basicfont.Face7x13.Ascent),
+	}
+	d.DrawString(*cameraName + " " + time.Now().Format("2006-01-02 15:04:05"))
+	return img
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+var rateLimit = flag.Float64("rate-limit", 0, "new /stream connections allowed per second from one IP address (0 disables)")
+
+// rateLimiterIdle is how long an IP address goes without connecting before its
+// limiter is pruned. Pruning runs as often.
+const rateLimiterIdle = 5 * time.Minute
+
+// ipRateLimiter is the connection limiter of one client IP address.
+type ipRateLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen atomic.Int64 // Unix nanoseconds of the last connection attempt
+}
+
+var (
+	rateLimiters      sync.Map // IP string to *ipRateLimiter
+	rateLimiterPruner sync.Once
+)
+
+// allowConnection reports whether ip may open another connection now and, if
+// not, how long it should wait.
+func allowConnection(ip string) (bool, time.Duration) {
+	burst := max(1, int(math.Ceil(*rateLimit)))
+	v, _ := rateLimiters.LoadOrStore(ip, &ipRateLimiter{limiter: rate.NewLimiter(rate.Limit(*rateLimit), burst)})
+	l := v.(*ipRateLimiter)
+	l.lastSeen.Store(time.Now().UnixNano())
+
+	r := l.limiter.Reserve()
+	if delay := r.Delay(); delay > 0 {
+		r.Cancel()
+		return false, delay
+	}
+	return true, 0
+}
+
+// pruneRateLimiters drops the limiters of addresses idle for rateLimiterIdle,
+// so the map does not grow with every client ever seen.
+func pruneRateLimiters() {
+	defer logPanic("pruneRateLimiters")
+
+	for range time.Tick(rateLimiterIdle) {
+		cutoff := time.Now().Add(-rateLimiterIdle).UnixNano()
+		rateLimiters.Range(func(key, v any) bool {
+			if v.(*ipRateLimiter).lastSeen.Load() < cutoff {
+				rateLimiters.Delete(key)
+			}
+			return true
+		})
+	}
+}
+
+// limitConnections answers 429 Too Many Requests, with Retry-After, to clients
+// opening connections faster than -rate-limit per second.
+func limitConnections(next http.HandlerFunc) http.HandlerFunc {
+	if *rateLimit <= 0 {
+		return next
+	}
+	rateLimiterPruner.Do(func() { go pruneRateLimiters() })
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r)
+		if ip == nil {
+			next(w, r)
+			return
+		}
+		if ok, wait := allowConnection(ip.String()); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "Too many connections, try again later", http.StatusTooManyRequests)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/jpeg"
+
+	"github.com/vladimirvivien/go4vl/v4l2"
+)
+
+var pixelFormat = flag.String("pixel-format", "mjpeg", "pixel format captured from the camera: mjpeg, yuyv or nv12 (raw formats are encoded to JPEG in software)")
+
+// pixelFmtNV12 is V4L2_PIX_FMT_NV12, which go4vl does not define.
+const pixelFmtNV12 v4l2.FourCCType = 'N' | 'V'<<8 | '1'<<16 | '2'<<24
+
+var pixelFormats = map[string]v4l2.FourCCType{
+	"mjpeg": v4l2.PixelFmtMJPEG,
+	"yuyv":  v4l2.PixelFmtYUYV,
+	"nv12":  pixelFmtNV12,
+}
+
+var errShortFrame = errors.New("frame shorter than its pixel format requires")
+
+// checkPixelFormat validates -pixel-format.
+func checkPixelFormat() error {
+	if _, ok := pixelFormats[*pixelFormat]; !ok {
+		return fmt.Errorf("unknown pixel format %q", *pixelFormat)
+	}
+	return nil
+}
+
+// frameToJPEG returns frame, captured from camera, as a JPEG image. MJPEG
+// frames are returned as they are; YUYV and NV12 frames are encoded at
+// processedQuality.
+func frameToJPEG(camera frameSource, frame []byte) ([]byte, error) {
+	if *pixelFormat == "mjpeg" {
+		return frame, nil
+	}
+	format, err := camera.GetPixFormat()
+	if err != nil {
+		return nil, err
+	}
+	w, h, stride := int(format.Width), int(format.Height), int(format.BytesPerLine)
+
+	var img *image.YCbCr
+	switch format.PixelFormat {
+	case v4l2.PixelFmtYUYV:
+		img, err = yuyvToYCbCr(frame, w, h, stride)
+	case pixelFmtNV12:
+		img, err = nv12ToYCbCr(frame, w, h, stride)
+	default:
+		return nil, fmt.Errorf("unsupported pixel format %s", fourCC(format.PixelFormat))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: processedQuality()}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// yuyvToYCbCr converts a packed YUYV 4:2:2 frame of w×h pixels, stride bytes
+// per line, to a 4:2:2 YCbCr image.
+func yuyvToYCbCr(frame []byte, w, h, stride int) (*image.YCbCr, error) {
+	if stride == 0 {
+		stride = w * 2
+	}
+	if len(frame) < stride*(h-1)+w*2 {
+		return nil, errShortFrame
+	}
+	img := image.NewYCbCr(image.Rect(0, 0, w, h), image.YCbCrSubsampleRatio422)
+	for y := range h {
+		row := frame[y*stride:]
+		yRow := img.Y[y*img.YStride:]
+		cRow := y * img.CStride
+		for x := range w / 2 {
+			yRow[2*x] = row[4*x]
+			img.Cb[cRow+x] = row[4*x+1]
+			yRow[2*x+1] = row[4*x+2]
+			img.Cr[cRow+x] = row[4*x+3]
+		}
+	}
+	return img, nil
+}
+
+// nv12ToYCbCr converts an NV12 frame of w×h pixels, stride bytes per line, to a
+// 4:2:0 YCbCr image. NV12 is a Y plane followed by a plane of interleaved Cb
+// and Cr samples at half the resolution.
+func nv12ToYCbCr(frame []byte, w, h, stride int) (*image.YCbCr, error) {
+	if stride == 0 {
+		stride = w
+	}
+	if len(frame) < stride*h+stride*(h/2-1)+w {
+		return nil, errShortFrame
+	}
+	img := image.NewYCbCr(image.Rect(0, 0, w, h), image.YCbCrSubsampleRatio420)
+	for y := range h {
+		copy(img.Y[y*img.YStride:y*img.YStride+w], frame[y*stride:])
+	}
+	uv := frame[stride*h:]
+	for y := range h / 2 {
+		row := uv[y*stride:]
+		cRow := y * img.CStride
+		for x := range w / 2 {
+			img.Cb[cRow+x] = row[2*x]
+			img.Cr[cRow+x] = row[2*x+1]
+		}
+	}
+	return img, nil
+}
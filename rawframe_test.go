@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"image/jpeg"
+	"math/rand"
+	"testing"
+)
+
+// benchmarkRawToJPEG measures the software path for raw camera frames:
+// conversion to YCbCr and JPEG encoding at processedQuality.
+func benchmarkRawToJPEG(b *testing.B, w, h int, convert func([]byte, int, int, int) error, bytesPerPixel float64) {
+	frame := make([]byte, int(float64(w*h)*bytesPerPixel))
+	rand.New(rand.NewSource(1)).Read(frame)
+
+	b.SetBytes(int64(len(frame)))
+	b.ReportAllocs()
+	for range b.N {
+		if err := convert(frame, w, h, 0); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func encodeYUYV(frame []byte, w, h, stride int) error {
+	img, err := yuyvToYCbCr(frame, w, h, stride)
+	if err != nil {
+		return err
+	}
+	return jpeg.Encode(&bytes.Buffer{}, img, &jpeg.Options{Quality: processedQuality()})
+}
+
+func encodeNV12(frame []byte, w, h, stride int) error {
+	img, err := nv12ToYCbCr(frame, w, h, stride)
+	if err != nil {
+		return err
+	}
+	return jpeg.Encode(&bytes.Buffer{}, img, &jpeg.Options{Quality: processedQuality()})
+}
+
+func BenchmarkYUYVToJPEG720p(b *testing.B)  { benchmarkRawToJPEG(b, 1280, 720, encodeYUYV, 2) }
+func BenchmarkYUYVToJPEG1080p(b *testing.B) { benchmarkRawToJPEG(b, 1920, 1080, encodeYUYV, 2) }
+func BenchmarkNV12ToJPEG720p(b *testing.B)  { benchmarkRawToJPEG(b, 1280, 720, encodeNV12, 1.5) }
+func BenchmarkNV12ToJPEG1080p(b *testing.B) { benchmarkRawToJPEG(b, 1920, 1080, encodeNV12, 1.5) }
+
+func TestNV12ToYCbCr(t *testing.T) {
+	// 4x2 frame with a stride of 6: two Y rows, then one row of CbCr pairs
+	frame := []byte{
+		1, 2, 3, 4, 0, 0,
+		5, 6, 7, 8, 0, 0,
+		10, 20, 30, 40, 0, 0,
+	}
+	img, err := nv12ToYCbCr(frame, 4, 2, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := img.Y[img.YStride : img.YStride+4]; !bytes.Equal(got, []byte{5, 6, 7, 8}) {
+		t.Errorf("second Y row = %v", got)
+	}
+	if !bytes.Equal(img.Cb[:2], []byte{10, 30}) || !bytes.Equal(img.Cr[:2], []byte{20, 40}) {
+		t.Errorf("Cb = %v, Cr = %v, want [10 30] and [20 40]", img.Cb[:2], img.Cr[:2])
+	}
+	if _, err := nv12ToYCbCr(frame[:len(frame)-3], 4, 2, 6); err != errShortFrame {
+		t.Errorf("short frame: err = %v, want errShortFrame", err)
+	}
+}
+
+func TestYUYVToYCbCr(t *testing.T) {
+	frame := []byte{1, 10, 2, 20, 3, 30, 4, 40}
+	img, err := yuyvToYCbCr(frame, 4, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(img.Y[:4], []byte{1, 2, 3, 4}) || !bytes.Equal(img.Cb[:2], []byte{10, 30}) || !bytes.Equal(img.Cr[:2], []byte{20, 40}) {
+		t.Errorf("Y = %v, Cb = %v, Cr = %v", img.Y[:4], img.Cb[:2], img.Cr[:2])
+	}
+}
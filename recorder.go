@@ -0,0 +1,442 @@
+//go:build recorder
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	shutdownFFmpegTimeout = flag.Int("shutdown-ffmpeg-timeout-seconds", 30, "how long to wait on shutdown for FFmpeg to finalize the current segment")
+	audioDevice           = flag.String("audio-device", "", "ALSA device to record audio from, e.g. hw:0,0 (empty records video only)")
+	segmentTime           = flag.Int("segment-time", 1800, "length of recorded segments in seconds, halved while free disk space is below -disk-warn-gb")
+	motionSegmentTime     = flag.Int("motion-segment-time", 60, "length of recorded segments in seconds while motion is detected (0 keeps -segment-time)")
+	organizeByCodec       = flag.Bool("organize-by-codec", false, "record into an h264, h265 or copy subdirectory of -video-dir matching the encoder")
+	ffmpegWriteTimeout    = flag.Duration("ffmpeg-write-timeout", 5*time.Second, "longest a frame write to the recording FFmpeg may block before FFmpeg is killed and restarted (0 disables)")
+)
+
+// minSegmentTime is the shortest segment time adaptive segmenting goes down to.
+const minSegmentTime = 10
+
+var (
+	ffmpegMutex    sync.Mutex
+	ffmpegCmd      *exec.Cmd      // Running FFmpeg recording process, nil when not recording
+	ffmpegIn       io.WriteCloser // Pipe for sending raw MJPEG frames to FFmpeg
+	ffmpegDone     chan error     // Receives the exit status of ffmpegCmd
+	ffmpegStopping *atomic.Bool   // Set when ffmpegCmd is being stopped on purpose
+	ffmpegStarted  time.Time
+	ffmpegBackoff  time.Duration
+	ffmpegRestart  *time.Timer    // Pending restart after a crash
+	sidecar        *sidecarWriter // Metadata of the frames sent to FFmpeg, nil when not recording
+)
+
+// ffmpegExit is the exit status of an FFmpeg recording process that exited
+// without being stopped.
+type ffmpegExit struct {
+	cmd *exec.Cmd
+	err error
+}
+
+// ffmpegExits receives the unexpected exits of FFmpeg. recordingWriter
+// handles them with handleFFmpegExit.
+var ffmpegExits = make(chan ffmpegExit, 1)
+
+// ffmpegArgs returns the arguments for the FFmpeg recording process writing
+// segments named by pattern. FFmpeg prints the name of each finished segment
+// to stdout.
+func ffmpegArgs(pattern string) []string {
+	args := []string{
+		"-loglevel", "level+debug", // Debug logging with level prefixes for logFFmpegOutput
+		"-y", // Overwrite output file if it exists
+	}
+	if *audioDevice != "" {
+		args = append(args, "-f", "alsa", "-i", *audioDevice)
+	}
+	args = append(args,
+		"-f", "mjpeg", // MJPEG format (because frames are JPEG images)
+		"-framerate", "15",
+		"-i", "pipe:0", // Read input from stdin (pipe)
+		"-vf", "drawtext=text="+drawtextEscape(*cameraName)+" %{localtime}:fontcolor=white:fontsize=24:x=10:y=10",
+		"-c:v", videoEncoder(), // -video-encoder or the encoder picked by probeEncoders
+		"-pix_fmt", "yuv420p",
+		"-b:v", recordingBitrate(), // Bitrate for video encoding
+	)
+	if *audioDevice != "" {
+		args = append(args, "-c:a", "aac", "-b:a", "128k")
+	}
+	if preset := recordingPreset(); preset != "" {
+		args = append(args, "-preset", preset)
+	}
+	args = append(args,
+		"-f", "segment",
+		"-r", "15", // Force framerate
+		"-reset_timestamps", "1",
+		"-use_wallclock_as_timestamps", "1",
+		"-segment_time", strconv.Itoa(segmentDuration()), // Segment duration (30 minutes by default)
+	)
+	args = append(args, segmentFormatArgs()...)
+	return append(args,
+		"-segment_atclocktime", "1", // Reset timestamps at each segment
+		"-strftime", "1",
+		"-vsync", "2",
+		"-segment_list", "pipe:1", // Report finished segments to watchSegments
+		"-segment_list_type", "flat",
+		pattern,
+	)
+}
+
+// drawtextEscape escapes s for the text of a drawtext filter given with -vf, so
+// it is shown literally: first for drawtext's %{} expansion, then for the
+// filter's option list, then for the filtergraph.
+func drawtextEscape(s string) string {
+	s = strings.NewReplacer(`\`, `\\`, `%`, `\%`).Replace(s)
+	s = strings.NewReplacer(`\`, `\\`, `'`, `\'`, `:`, `\:`).Replace(s)
+	return strings.NewReplacer(`\`, `\\`, `'`, `\'`, `,`, `\,`, `;`, `\;`, `[`, `\[`, `]`, `\]`).Replace(s)
+}
+
+// segmentFormatArgs returns the FFmpeg segment muxer options for -container.
+func segmentFormatArgs() []string {
+	switch *container {
+	case "mp4":
+		return []string{"-segment_format", "mp4", "-segment_format_options", "movflags=+faststart+frag_keyframe"}
+	case "ts":
+		return []string{"-segment_format", "mpegts"} // Also usable as HLS segments
+	default:
+		return []string{"-segment_format", "mkv"}
+	}
+}
+
+// recordingDir returns the directory FFmpeg writes segments to.
+func recordingDir() string {
+	if !*organizeByCodec {
+		return recordingRoot()
+	}
+	return filepath.Join(recordingRoot(), encoderCodec(videoEncoder()))
+}
+
+// encoderCodec returns the codec subdirectory for clips made by encoder.
+func encoderCodec(encoder string) string {
+	switch {
+	case encoder == "copy":
+		return "copy"
+	case strings.Contains(encoder, "265"), strings.Contains(encoder, "hevc"):
+		return "h265"
+	default:
+		return "h264"
+	}
+}
+
+// startRecording starts the FFmpeg subprocess that writes segmented H.264 MKV
+// files. It does nothing if FFmpeg is already running.
+func startRecording() error {
+	ffmpegMutex.Lock()
+	defer ffmpegMutex.Unlock()
+	if ffmpegCmd != nil {
+		return nil
+	}
+
+	pattern, err := segmentPattern(recordingDir())
+	if err != nil {
+		return fmt.Errorf("render -segment-name: %w", err)
+	}
+	// Segments go to the directory of the rendered name. FFmpeg lists them by
+	// base name only.
+	dir := filepath.Dir(pattern)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("create recording directory: %w", err)
+	}
+	cmd := exec.Command(*ffmpegPath, ffmpegArgs(pattern)...)
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("create FFmpeg stdin pipe: %w", err)
+	}
+	segments, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("create FFmpeg stdout pipe: %w", err)
+	}
+	stderr, err := pipeFFmpegLog(cmd, "recording")
+	if err != nil {
+		return err
+	}
+	err = cmd.Start()
+	stderr.Close()
+	if err != nil {
+		return fmt.Errorf("start FFmpeg process: %w", err)
+	}
+
+	sc, err := newSidecarWriter(dir)
+	if err != nil {
+		slog.Error("failed to start frame sidecar", "dir", dir, "error", err)
+	}
+	done, stopping := make(chan error, 1), new(atomic.Bool)
+	go func() {
+		err := cmd.Wait()
+		done <- err
+		if !stopping.Load() {
+			ffmpegExits <- ffmpegExit{cmd: cmd, err: err}
+		}
+	}()
+	ffmpegCmd, ffmpegIn, sidecar = cmd, in, sc
+	ffmpegDone, ffmpegStopping, ffmpegStarted = done, stopping, time.Now()
+	go watchSegments(segments, dir, sc)
+	updateState(func(s *recorderState) { s.RecordingDir, s.RecordedSince = dir, time.Now() })
+	slog.Info("recording started", "pid", cmd.Process.Pid)
+	publishEvent("recording", map[string]any{"state": "started", "timestamp": time.Now().Format(time.RFC3339)})
+	return nil
+}
+
+// stopRecording closes FFmpeg's input and waits for it to finish the current
+// segment. It does nothing if FFmpeg is not running.
+func stopRecording() error {
+	ffmpegMutex.Lock()
+	defer ffmpegMutex.Unlock()
+	cancelFFmpegRestart()
+	if ffmpegCmd == nil {
+		return nil
+	}
+
+	ffmpegStopping.Store(true)
+	ffmpegIn.Close()
+	err := <-ffmpegDone
+	ffmpegCmd, ffmpegIn, sidecar = nil, nil, nil
+	slog.Info("recording stopped")
+	publishEvent("recording", map[string]any{"state": "stopped", "timestamp": time.Now().Format(time.RFC3339)})
+	if err != nil {
+		return fmt.Errorf("FFmpeg exited: %w", err)
+	}
+	return nil
+}
+
+// finalizeRecording interrupts FFmpeg so it finishes writing the current
+// segment, and kills it if it has not exited within timeout. It is used on
+// shutdown, where abandoning FFmpeg would leave a truncated MKV file.
+func finalizeRecording(timeout time.Duration) error {
+	ffmpegMutex.Lock()
+	defer ffmpegMutex.Unlock()
+	cancelFFmpegRestart()
+	if ffmpegCmd == nil {
+		return nil
+	}
+
+	slog.Info("waiting for FFmpeg to finalize segment", "timeout", timeout)
+	ffmpegStopping.Store(true)
+	ffmpegIn.Close()
+	if err := ffmpegCmd.Process.Signal(os.Interrupt); err != nil {
+		slog.Warn("failed to interrupt FFmpeg", "error", err)
+	}
+
+	var err error
+	select {
+	case err = <-ffmpegDone:
+	case <-time.After(timeout):
+		slog.Error("FFmpeg did not finalize segment in time, killing it", "timeout", timeout)
+		ffmpegCmd.Process.Kill()
+		err = <-ffmpegDone
+	}
+	ffmpegCmd, ffmpegIn, sidecar = nil, nil, nil
+	slog.Info("recording stopped")
+	publishEvent("recording", map[string]any{"state": "stopped", "timestamp": time.Now().Format(time.RFC3339)})
+	if err != nil {
+		return fmt.Errorf("FFmpeg exited: %w", err)
+	}
+	return nil
+}
+
+// handleFFmpegExit cleans up after FFmpeg exited without being stopped and,
+// if it failed, restarts it after a backoff like the camera's: doubling with
+// each crash in a row up to maxRestartBackoff, and reset by a run longer than
+// that.
+func handleFFmpegExit(exit ffmpegExit) {
+	ffmpegMutex.Lock()
+	defer ffmpegMutex.Unlock()
+	if ffmpegCmd != exit.cmd {
+		return
+	}
+
+	ffmpegIn.Close()
+	ran := time.Since(ffmpegStarted)
+	ffmpegCmd, ffmpegIn, sidecar = nil, nil, nil
+	publishEvent("recording", map[string]any{"state": "stopped", "timestamp": time.Now().Format(time.RFC3339)})
+	if exit.err == nil {
+		slog.Warn("FFmpeg exited unexpectedly, recording stopped", "ran", ran)
+		return
+	}
+
+	if ran > maxRestartBackoff || ffmpegBackoff == 0 {
+		ffmpegBackoff = minRestartBackoff
+	} else {
+		ffmpegBackoff = min(2*ffmpegBackoff, maxRestartBackoff)
+	}
+	slog.Error("FFmpeg crashed, restarting recording", "error", exit.err, "ran", ran, "backoff", ffmpegBackoff)
+	ffmpegRestart = time.AfterFunc(ffmpegBackoff, func() {
+		if err := startRecording(); err != nil {
+			slog.Error("failed to restart recording", "error", err)
+		}
+	})
+}
+
+// cancelFFmpegRestart stops a pending restart after a crash, so recording
+// stopped on purpose stays stopped. The caller must hold ffmpegMutex.
+func cancelFFmpegRestart() {
+	if ffmpegRestart != nil {
+		ffmpegRestart.Stop()
+		ffmpegRestart = nil
+	}
+}
+
+var errFFmpegWriteTimeout = errors.New("FFmpeg write timed out")
+
+// recordChan carries frames from frameBroadcaster to recordingWriter. It holds
+// two seconds of frames so short FFmpeg stalls do not lose any.
+var recordChan = make(chan []byte, 30)
+
+// recordingWriter writes the frames from recordChan to the recording FFmpeg
+// and the sinks, and restarts FFmpeg when it crashes.
+func recordingWriter() {
+	defer logPanic("recordingWriter")
+
+	for {
+		select {
+		case exit := <-ffmpegExits:
+			handleFFmpegExit(exit)
+		case frame := <-recordChan:
+			// Write the raw MJPEG frame (JPEG image) to FFmpeg's stdin. If FFmpeg
+			// died its exit arrives on ffmpegExits and restarts it.
+			if err := writeRecordingFrame(frame); err != nil {
+				slog.Error("failed to write frame to FFmpeg", "error", err)
+			}
+			writeSinkFrames(frame)
+		}
+	}
+}
+
+// writeRecordingFrame sends a raw MJPEG frame to FFmpeg. Frames are discarded
+// while not recording.
+func writeRecordingFrame(frame []byte) error {
+	ffmpegMutex.Lock()
+	defer ffmpegMutex.Unlock()
+	if ffmpegIn == nil {
+		return nil
+	}
+	if sidecar != nil {
+		sidecar.writeFrame(frame)
+	}
+	if *ffmpegWriteTimeout <= 0 {
+		_, err := ffmpegIn.Write(frame)
+		return err
+	}
+
+	in, done := ffmpegIn, make(chan error, 1)
+	go func() {
+		_, err := in.Write(frame)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(*ffmpegWriteTimeout):
+		// Killing FFmpeg fails the pending write and sends its exit to
+		// ffmpegExits, which restarts it
+		slog.Error("frame write to FFmpeg timed out, killing it", "timeout", *ffmpegWriteTimeout, "pid", ffmpegCmd.Process.Pid)
+		ffmpegCmd.Process.Kill()
+		return errFFmpegWriteTimeout
+	}
+}
+
+// restartRecordingForLoad restarts a running FFmpeg so it picks up the bitrate
+// and preset for the new CPU load. It is installed as onLoadChange.
+func restartRecordingForLoad(degraded bool) {
+	slog.Info("restarting recording for new bitrate", "bitrate", recordingBitrate(), "preset", recordingPreset(), "degraded", degraded)
+	restartRecording()
+}
+
+// restartRecordingForDisk restarts a running FFmpeg so it picks up the segment
+// time for the new free space. It is installed as onDiskLow.
+func restartRecordingForDisk(low bool) {
+	slog.Info("restarting recording for new segment time", "segment_time", segmentDuration(), "disk_low", low)
+	restartRecording()
+}
+
+var (
+	motionSegments      atomic.Bool // Recording with -motion-segment-time
+	motionSegmentsMutex sync.Mutex
+	motionSegmentsTimer *time.Timer // Switches back to -segment-time once motion has stopped
+)
+
+// restartRecordingForMotion switches to -motion-segment-time when motion
+// starts, so segments with activity are short and easy to find. Once motion
+// has stopped for a whole motion segment it switches back. It is installed as
+// onMotionChange.
+func restartRecordingForMotion(detected bool) {
+	if *motionSegmentTime <= 0 || *motionSegmentTime >= *segmentTime {
+		return
+	}
+	motionSegmentsMutex.Lock()
+	defer motionSegmentsMutex.Unlock()
+
+	if motionSegmentsTimer != nil {
+		motionSegmentsTimer.Stop()
+		motionSegmentsTimer = nil
+	}
+	if !detected {
+		motionSegmentsTimer = time.AfterFunc(time.Duration(*motionSegmentTime)*time.Second, func() {
+			if motionDetected.Load() || !motionSegments.CompareAndSwap(true, false) {
+				return
+			}
+			slog.Info("restarting recording for new segment time", "segment_time", segmentDuration(), "motion", false)
+			restartRecording()
+		})
+		return
+	}
+	if motionSegments.CompareAndSwap(false, true) {
+		slog.Info("restarting recording for new segment time", "segment_time", segmentDuration(), "motion", true)
+		go restartRecording()
+	}
+}
+
+// restartRecording stops and starts FFmpeg so it is run with the current
+// arguments. It does nothing if FFmpeg is not running.
+func restartRecording() {
+	ffmpegMutex.Lock()
+	recording := ffmpegCmd != nil
+	ffmpegMutex.Unlock()
+	if !recording {
+		return
+	}
+
+	if err := stopRecording(); err != nil {
+		slog.Error("failed to stop recording", "error", err)
+	}
+	if err := startRecording(); err != nil {
+		slog.Error("failed to restart recording", "error", err)
+	}
+}
+
+// segmentDuration returns the -segment_time for recording: -segment-time,
+// halved while free disk space is low and cut to -motion-segment-time around
+// motion. Shortened segments are at least minSegmentTime long.
+func segmentDuration() int {
+	d := *segmentTime
+	if diskLow.Load() {
+		d /= 2
+	}
+	if motionSegments.Load() {
+		d = min(d, *motionSegmentTime)
+	}
+	if d < *segmentTime {
+		d = max(d, min(minSegmentTime, *segmentTime))
+	}
+	return d
+}
@@ -0,0 +1,33 @@
+//go:build recorder
+
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestFFmpegArgsOverlay(t *testing.T) {
+	saved := *cameraName
+	t.Cleanup(func() { *cameraName = saved })
+
+	tests := []struct {
+		name, want string
+	}{
+		{"Porch", `drawtext=text=Porch %{localtime}:fontcolor=white:fontsize=24:x=10:y=10`},
+		// Unescaped, each level would end the option, quote or expand part of the name
+		{`Porch: 'A' 50%`, `drawtext=text=Porch\\: \\\'A\\\' 50\\\\% %{localtime}:fontcolor=white:fontsize=24:x=10:y=10`},
+		{`Yard [1], gate; C:\cam`, `drawtext=text=Yard \[1\]\, gate\; C\\:\\\\\\\\cam %{localtime}:fontcolor=white:fontsize=24:x=10:y=10`},
+	}
+	for _, tt := range tests {
+		*cameraName = tt.name
+		args := ffmpegArgs("clip_%Y%m%d.mkv")
+		i := slices.Index(args, "-vf")
+		if i < 0 || i+1 >= len(args) {
+			t.Fatalf("ffmpegArgs has no -vf: %q", args)
+		}
+		if got := args[i+1]; got != tt.want {
+			t.Errorf("camera name %q: -vf %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// ResizeProcessor downscales frames to Width pixels wide, or by Scale when
+// Width is 0, keeping the aspect ratio. Frames are never upscaled.
+type ResizeProcessor struct {
+	Width int
+	Scale float64
+}
+
+// newResizeProcessor returns the ResizeProcessor requested by the ?width= or
+// ?scale= (e.g. "50%") stream query parameters, or nil if neither is set.
+func newResizeProcessor(query url.Values) (*ResizeProcessor, error) {
+	if w := query.Get("width"); w != "" {
+		width, err := strconv.Atoi(w)
+		if err != nil || width < 1 {
+			return nil, errors.New("width must be a positive number of pixels")
+		}
+		return &ResizeProcessor{Width: width}, nil
+	}
+	if s := query.Get("scale"); s != "" {
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+		if err != nil || percent <= 0 || percent > 100 {
+			return nil, errors.New("scale must be a percentage between 0 and 100")
+		}
+		return &ResizeProcessor{Scale: percent / 100}, nil
+	}
+	return nil, nil
+}
+
+func (p *ResizeProcessor) Process(frame []byte) ([]byte, error) {
+	src, err := jpeg.Decode(bytes.NewReader(frame))
+	if err != nil {
+		return nil, fmt.Errorf("decode frame: %w", err)
+	}
+
+	b := src.Bounds()
+	width := p.Width
+	if width == 0 {
+		width = int(float64(b.Dx()) * p.Scale)
+	}
+	if width >= b.Dx() {
+		return frame, nil
+	}
+	height := max(1, b.Dy()*width/b.Dx())
+
+	dst := image.NewRGBA(image.Rect(0, 0, max(1, width), height))
+	draw.BiLinear.Scale(dst, dst.Bounds(), src, b, draw.Src, nil)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: processedQuality()}); err != nil {
+		return nil, fmt.Errorf("encode frame: %w", err)
+	}
+	return buf.Bytes(), nil
+}
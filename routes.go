@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// registerRoutes adds the HTTP endpoints to mux: those of both builds here,
+// then the build's own with registerBuildRoutes.
+func registerRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /{$}", indexHandler)
+	mux.Handle("GET /static/", staticHandler())
+	mux.HandleFunc("/stream", limitConnections(imageServ))
+	mux.HandleFunc("GET /snapshot", snapshotHandler)
+	mux.HandleFunc("/videos", listVideosHandler)
+	mux.HandleFunc("/download/", downloadHandler)
+	mux.HandleFunc("GET /api/videos", searchVideosHandler)
+	mux.HandleFunc("GET /api/videos/export", exportHandler)
+	mux.Handle("/thumbs/", http.StripPrefix("/thumbs/", http.FileServer(http.Dir(thumbDir))))
+	mux.HandleFunc("POST /api/clips/{filename...}", playbackTokenHandler)
+	mux.HandleFunc("GET /play/{name}", playHandler)
+	mux.HandleFunc("POST /api/clips/from-snapshots", requireRole(RoleOperator, timelapseHandler))
+	mux.HandleFunc("GET /api/clips/continuity", continuityHandler)
+	mux.HandleFunc("GET /api/clips/playlist.m3u", playlistHandler)
+	mux.HandleFunc("GET /api/clips/playlist.m3u8", hlsPlaylistHandler)
+	mux.HandleFunc("/events", eventsHandler)
+	mux.HandleFunc("GET /api/motion/exclusions", motionExclusionsHandler)
+	mux.HandleFunc("POST /api/motion/exclusions", requireRole(RoleAdmin, motionExclusionsHandler))
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.Handle("GET /metrics", promhttp.Handler())
+	mux.HandleFunc("GET /bandwidth-test", bandwidthTestHandler)
+	mux.HandleFunc("GET /api/system", systemHandler)
+	mux.HandleFunc("GET /api/system/memory", memoryHandler)
+	mux.HandleFunc("GET /api/devices", devicesHandler)
+	mux.HandleFunc("GET /api/devices/{dev}/formats", deviceFormatsHandler)
+	mux.HandleFunc("GET /api/camera/capabilities", cameraCapabilitiesHandler)
+	mux.HandleFunc("/restart", requireRole(RoleOperator, resetCameraWeb))
+	registerBuildRoutes(mux)
+}
@@ -0,0 +1,71 @@
+//go:build recorder
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+var (
+	recordSchedule     = flag.String("record-schedule", "", "cron expression for when recording starts (empty records all the time)")
+	recordStopSchedule = flag.String("record-stop-schedule", "", "cron expression for when scheduled recording stops")
+)
+
+// parseRecordSchedule parses the -record-schedule and -record-stop-schedule
+// flags. Both are nil when no schedule is configured.
+func parseRecordSchedule() (start, stop cron.Schedule, err error) {
+	if *recordSchedule == "" && *recordStopSchedule == "" {
+		return nil, nil, nil
+	}
+	if *recordSchedule == "" || *recordStopSchedule == "" {
+		return nil, nil, errors.New("-record-schedule and -record-stop-schedule must be set together")
+	}
+
+	start, err = cron.ParseStandard(*recordSchedule)
+	if err != nil {
+		return nil, nil, fmt.Errorf("-record-schedule: %w", err)
+	}
+	stop, err = cron.ParseStandard(*recordStopSchedule)
+	if err != nil {
+		return nil, nil, fmt.Errorf("-record-stop-schedule: %w", err)
+	}
+	return start, stop, nil
+}
+
+// recordScheduler starts and stops recording according to the schedules. If
+// the next stop comes before the next start we are inside a recording window,
+// so recording starts immediately.
+func recordScheduler(start, stop cron.Schedule) {
+	defer logPanic("recordScheduler")
+
+	now := time.Now()
+	if stop.Next(now).Before(start.Next(now)) {
+		if err := startRecording(); err != nil {
+			slog.Error("failed to start scheduled recording", "error", err)
+		}
+	}
+
+	for {
+		now := time.Now()
+		nextStart, nextStop := start.Next(now), stop.Next(now)
+		if nextStart.Before(nextStop) {
+			slog.Info("next scheduled recording", "start", nextStart)
+			time.Sleep(time.Until(nextStart))
+			if err := startRecording(); err != nil {
+				slog.Error("failed to start scheduled recording", "error", err)
+			}
+		} else {
+			slog.Info("scheduled recording ends", "stop", nextStop)
+			time.Sleep(time.Until(nextStop))
+			if err := stopRecording(); err != nil {
+				slog.Error("failed to stop scheduled recording", "error", err)
+			}
+		}
+	}
+}
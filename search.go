@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSearchLimit = 100
+	maxSearchLimit     = 1000
+)
+
+// videoFilter selects videos for /api/videos. Zero fields do not filter.
+type videoFilter struct {
+	From, To     time.Time
+	MinSize      int64
+	MaxSize      int64 // -1 for no maximum
+	NameContains string
+}
+
+// videoResult is a video in the /api/videos response.
+type videoResult struct {
+	Name     string `json:"name"`
+	Codec    string `json:"codec,omitempty"`
+	Size     int64  `json:"size_bytes"`
+	Modified string `json:"modified"`
+	URL      string `json:"url"`
+	Thumb    string `json:"thumbnail_url,omitempty"`
+}
+
+// videoSearchPage is the /api/videos response.
+type videoSearchPage struct {
+	Total  int           `json:"total"`
+	Limit  int           `json:"limit"`
+	Offset int           `json:"offset"`
+	Videos []videoResult `json:"videos"`
+}
+
+// parseVideoFilter reads the from, to, min_size_bytes, max_size_bytes and
+// name_contains query parameters.
+func parseVideoFilter(q url.Values) (videoFilter, error) {
+	f := videoFilter{MaxSize: -1, NameContains: q.Get("name_contains")}
+	var err error
+	if s := q.Get("from"); s != "" {
+		if f.From, err = time.Parse(time.RFC3339, s); err != nil {
+			return f, errors.New("invalid from, expected an RFC 3339 timestamp")
+		}
+	}
+	if s := q.Get("to"); s != "" {
+		if f.To, err = time.Parse(time.RFC3339, s); err != nil {
+			return f, errors.New("invalid to, expected an RFC 3339 timestamp")
+		}
+	}
+	if s := q.Get("min_size_bytes"); s != "" {
+		if f.MinSize, err = strconv.ParseInt(s, 10, 64); err != nil || f.MinSize < 0 {
+			return f, errors.New("invalid min_size_bytes")
+		}
+	}
+	if s := q.Get("max_size_bytes"); s != "" {
+		if f.MaxSize, err = strconv.ParseInt(s, 10, 64); err != nil || f.MaxSize < 0 {
+			return f, errors.New("invalid max_size_bytes")
+		}
+	}
+	return f, nil
+}
+
+// match reports whether v passes the filter. from and to are inclusive.
+func (f videoFilter) match(v videoEntry) bool {
+	switch {
+	case !f.From.IsZero() && v.ModTime.Before(f.From):
+		return false
+	case !f.To.IsZero() && v.ModTime.After(f.To):
+		return false
+	case v.Size < f.MinSize:
+		return false
+	case f.MaxSize >= 0 && v.Size > f.MaxSize:
+		return false
+	case f.NameContains != "" && !strings.Contains(v.Name, f.NameContains):
+		return false
+	}
+	return true
+}
+
+// queryInt returns the integer query parameter name, or def when it is absent.
+func queryInt(q url.Values, name string, def int) (int, error) {
+	s := q.Get(name)
+	if s == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s", name)
+	}
+	return n, nil
+}
+
+// searchVideosHandler lists the videos of /videos as JSON, newest first,
+// filtered by modification time, size and name, and paginated with limit and
+// offset.
+func searchVideosHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter, err := parseVideoFilter(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit, err := queryInt(q, "limit", defaultSearchLimit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit = min(limit, maxSearchLimit)
+	offset, err := queryInt(q, "offset", 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	videos, err := listVideos()
+	if err != nil {
+		http.Error(w, "Unable to read directory", http.StatusInternalServerError)
+		return
+	}
+	videos = slices.DeleteFunc(videos, func(v videoEntry) bool { return !filter.match(v) })
+	slices.SortFunc(videos, func(a, b videoEntry) int {
+		if c := b.ModTime.Compare(a.ModTime); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	page := videoSearchPage{Total: len(videos), Limit: limit, Offset: offset, Videos: []videoResult{}}
+	start := min(offset, len(videos))
+	for _, v := range videos[start : start+min(limit, len(videos)-start)] {
+		page.Videos = append(page.Videos, videoResult{
+			Name:     v.Name,
+			Codec:    v.Codec,
+			Size:     v.Size,
+			Modified: v.ModTime.Format(time.RFC3339),
+			URL:      (&url.URL{Path: "/download/" + v.Name}).EscapedPath(),
+			Thumb:    v.Thumb,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(page); err != nil {
+		slog.Error("failed to encode video search results", "error", err)
+	}
+}
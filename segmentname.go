@@ -0,0 +1,75 @@
+//go:build recorder
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+var segmentName = flag.String("segment-name", "compressed_%Y%m%dT%H%M%S",
+	"Go template for recorded segment paths relative to the recording directory, without extension. "+
+		"{{.Time}} is when FFmpeg started, {{.Device}} the camera device name and {{.Index}} counts FFmpeg starts from 1; "+
+		"FFmpeg expands strftime %-sequences for every segment")
+
+// segmentNameTemplate is -segment-name, parsed by checkSegmentName.
+var segmentNameTemplate *template.Template
+
+// segmentNameVars are the variables available to -segment-name.
+type segmentNameVars struct {
+	Time   time.Time
+	Device string // Base name of -device, e.g. video0
+	Index  int
+}
+
+// segmentIndex counts the FFmpeg recording processes started. It is only used
+// with ffmpegMutex held.
+var segmentIndex int
+
+// checkSegmentName parses -segment-name and checks that it renders to a path
+// inside the recording directory.
+func checkSegmentName() error {
+	tmpl, err := template.New("segment-name").Option("missingkey=error").Parse(*segmentName)
+	if err != nil {
+		return err
+	}
+	segmentNameTemplate = tmpl
+	_, err = renderSegmentName(segmentNameVars{Time: time.Now(), Device: "video0", Index: 1})
+	return err
+}
+
+// renderSegmentName renders -segment-name with vars into a relative path.
+func renderSegmentName(vars segmentNameVars) (string, error) {
+	var b strings.Builder
+	if err := segmentNameTemplate.Execute(&b, vars); err != nil {
+		return "", err
+	}
+	name := filepath.Clean(b.String())
+	if name == "." || !filepath.IsLocal(name) {
+		return "", fmt.Errorf("segment name %q is not a path inside the recording directory", b.String())
+	}
+	if strings.Contains(filepath.Dir(name), "%") {
+		return "", errors.New("segment name directories cannot contain strftime sequences, FFmpeg does not create them")
+	}
+	return name, nil
+}
+
+// segmentPattern returns the FFmpeg output pattern for the next recording in
+// dir. The caller must hold ffmpegMutex.
+func segmentPattern(dir string) (string, error) {
+	segmentIndex++
+	name, err := renderSegmentName(segmentNameVars{
+		Time:   time.Now(),
+		Device: filepath.Base(devName),
+		Index:  segmentIndex,
+	})
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, name+clipExt()), nil
+}
@@ -0,0 +1,102 @@
+//go:build recorder
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+var postProcess = flag.String("post-process", "", "program run with the path of each finished segment as its argument")
+
+// SegmentEvent describes a segment FFmpeg has finished writing.
+type SegmentEvent struct {
+	Path     string
+	Duration time.Duration // From the start time in the name to the last write
+	Size     int64
+}
+
+// segmentEvents receives an event for every finished segment. Events are
+// dropped when nobody keeps up with the channel.
+var segmentEvents = make(chan SegmentEvent, 16)
+
+// onSegmentFinished, when set, is called with the path of every finished
+// segment once -post-process is done with it. Unlike segmentEvents it sees
+// every segment.
+var onSegmentFinished func(path string)
+
+// watchSegments handles each segment FFmpeg reports as finished on r: it
+// names the frame sidecar after it, generates the thumbnail, runs
+// -post-process and publishes a SegmentEvent. Segment names are relative to
+// dir. sidecar may be nil.
+func watchSegments(r io.Reader, dir string, sidecar *sidecarWriter) {
+	defer logPanic("watchSegments")
+	if sidecar != nil {
+		defer sidecar.close()
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		src := filepath.Join(dir, filepath.Base(scanner.Text()))
+		info, err := os.Stat(src)
+		if err != nil {
+			slog.Warn("finished segment is missing", "path", src, "error", err)
+			continue
+		}
+		if sidecar != nil {
+			sidecar.rotate(src)
+		}
+		updateState(func(s *recorderState) { s.LastSegment = src })
+		event := SegmentEvent{Path: src, Size: info.Size()}
+		if stamp := clipTimePattern.FindString(info.Name()); stamp != "" {
+			if start, err := time.ParseInLocation("20060102T150405", stamp, time.Local); err == nil {
+				event.Duration = info.ModTime().Sub(start)
+			}
+		}
+		slog.Info("segment finished", "path", event.Path, "duration", event.Duration, "size", event.Size)
+
+		if clip, err := filepath.Rel(recordingRoot(), src); err == nil {
+			if err := generateThumbnail(filepath.ToSlash(clip), src); err != nil {
+				slog.Warn("failed to generate thumbnail", "clip", clip, "error", err)
+			}
+		}
+		if *postProcess != "" || onSegmentFinished != nil {
+			go handOffSegment(src)
+		}
+
+		select {
+		case segmentEvents <- event:
+		default:
+			slog.Debug("segment event channel full, dropping event", "path", src)
+		}
+	}
+}
+
+// handOffSegment runs -post-process on the segment at path to completion, and
+// only then passes it to onSegmentFinished, which may move or delete it.
+func handOffSegment(path string) {
+	defer logPanic("handOffSegment")
+
+	if *postProcess != "" {
+		runPostProcess(path)
+	}
+	if onSegmentFinished != nil {
+		onSegmentFinished(path)
+	}
+}
+
+// runPostProcess runs -post-process on the segment at path.
+func runPostProcess(path string) {
+	out, err := exec.Command(*postProcess, path).CombinedOutput()
+	if err != nil {
+		slog.Error("post-process failed", "program", *postProcess, "path", path, "error", err, "output", string(out))
+		return
+	}
+	slog.Debug("post-process finished", "program", *postProcess, "path", path)
+}
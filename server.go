@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+var (
+	readTimeout  = flag.Duration("read-timeout", 15*time.Second, "longest time to read a request, including its body (0 disables)")
+	writeTimeout = flag.Duration("write-timeout", 30*time.Second, "longest time a response may stall before the connection is closed (0 disables)")
+	idleTimeout  = flag.Duration("idle-timeout", 2*time.Minute, "how long idle keep-alive connections are kept open (0 uses -read-timeout)")
+	tlsCert      = flag.String("tls-cert", "", "serve HTTPS with this certificate file (requires -tls-key)")
+	tlsKey       = flag.String("tls-key", "", "private key file of -tls-cert")
+	tlsCA        = flag.String("tls-ca", "", "CA certificate file; /api/* then requires a client certificate signed by it (requires -tls-cert)")
+)
+
+// newServer returns the HTTP server for handler with the -read-timeout,
+// -write-timeout and -idle-timeout flags applied, and the client CAs of
+// -tls-ca.
+func newServer(addr string, handler http.Handler) (*http.Server, error) {
+	srv := &http.Server{
+		Addr:         addr,
+		Handler:      handler,
+		ReadTimeout:  *readTimeout,
+		WriteTimeout: *writeTimeout,
+		IdleTimeout:  *idleTimeout,
+	}
+	if (*tlsCert == "") != (*tlsKey == "") {
+		return nil, errors.New("-tls-cert and -tls-key must be set together")
+	}
+	if *tlsCA == "" {
+		return srv, nil
+	}
+	if *tlsCert == "" {
+		return nil, errors.New("-tls-ca requires -tls-cert")
+	}
+	pem, err := os.ReadFile(*tlsCA)
+	if err != nil {
+		return nil, err
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s: no PEM certificates", *tlsCA)
+	}
+	// The stream and dashboard stay reachable without a certificate;
+	// requireClientCert enforces one on /api/*.
+	srv.TLSConfig = &tls.Config{
+		ClientCAs:  clientCAs,
+		ClientAuth: tls.VerifyClientCertIfGiven,
+	}
+	return srv, nil
+}
+
+// listenAndServe serves srv over HTTPS when -tls-cert is set and plain HTTP
+// otherwise.
+func listenAndServe(srv *http.Server) error {
+	if *tlsCert != "" {
+		return srv.ListenAndServeTLS(*tlsCert, *tlsKey)
+	}
+	return srv.ListenAndServe()
+}
+
+// extendWriteDeadline moves the write deadline -write-timeout into the future.
+// Handlers of long-lived responses call it before each write, so that
+// -write-timeout limits how long a single write stalls rather than the whole
+// response.
+func extendWriteDeadline(rc *http.ResponseController) {
+	if *writeTimeout > 0 {
+		rc.SetWriteDeadline(time.Now().Add(*writeTimeout))
+	}
+}
+
+// longResponseWriter extends the write deadline before every write.
+type longResponseWriter struct {
+	http.ResponseWriter
+	rc *http.ResponseController
+}
+
+// longResponse wraps w for responses, such as clip downloads, that may take
+// longer than -write-timeout to send in full.
+func longResponse(w http.ResponseWriter) http.ResponseWriter {
+	return &longResponseWriter{ResponseWriter: w, rc: http.NewResponseController(w)}
+}
+
+func (w *longResponseWriter) Write(b []byte) (int, error) {
+	extendWriteDeadline(w.rc)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *longResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
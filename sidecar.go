@@ -0,0 +1,116 @@
+//go:build recorder
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sidecarFrame is a line of a segment's metadata sidecar.
+type sidecarFrame struct {
+	Seq    uint64 `json:"seq"`
+	TS     string `json:"ts"`
+	Size   int    `json:"size_bytes"`
+	Motion bool   `json:"motion"`
+}
+
+// sidecarWriter writes a JSON line for every frame sent to one FFmpeg process.
+// Lines go to a temporary file that is renamed after each segment FFmpeg
+// finishes, so segment.mkv gets segment.jsonl alongside it.
+type sidecarWriter struct {
+	mutex sync.Mutex
+	dir   string
+	f     *os.File
+	w     *bufio.Writer
+	enc   *json.Encoder
+	seq   uint64
+}
+
+// newSidecarWriter starts the sidecar for the first segment written to dir.
+func newSidecarWriter(dir string) (*sidecarWriter, error) {
+	s := &sidecarWriter{dir: dir}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// open starts a new temporary sidecar file.
+func (s *sidecarWriter) open() error {
+	f, err := os.CreateTemp(s.dir, ".sidecar-*.jsonl")
+	if err != nil {
+		return err
+	}
+	s.f, s.w, s.seq = f, bufio.NewWriter(f), 0
+	s.enc = json.NewEncoder(s.w)
+	return nil
+}
+
+// writeFrame records frame as the next frame of the current segment.
+func (s *sidecarWriter) writeFrame(frame []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.f == nil {
+		return
+	}
+	s.seq++
+	err := s.enc.Encode(sidecarFrame{
+		Seq:    s.seq,
+		TS:     time.Now().UTC().Format("2006-01-02T15:04:05.000Z07:00"),
+		Size:   len(frame),
+		Motion: motionDetected.Load(),
+	})
+	if err != nil {
+		slog.Error("failed to write frame sidecar", "path", s.f.Name(), "error", err)
+	}
+}
+
+// rotate names the current sidecar after the finished segment at path and
+// starts the sidecar of the next segment.
+func (s *sidecarWriter) rotate(path string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.f == nil {
+		return
+	}
+	tmp := s.f.Name()
+	if err := s.closeFile(); err != nil {
+		slog.Error("failed to close frame sidecar", "path", tmp, "error", err)
+	}
+	dst := strings.TrimSuffix(path, filepath.Ext(path)) + ".jsonl"
+	if err := os.Rename(tmp, dst); err != nil {
+		slog.Error("failed to rename frame sidecar", "path", tmp, "segment", path, "error", err)
+	}
+	if err := s.open(); err != nil {
+		slog.Error("failed to start frame sidecar", "dir", s.dir, "error", err)
+	}
+}
+
+// close ends the sidecar once FFmpeg has exited, removing the frames of a
+// segment FFmpeg never reported as finished.
+func (s *sidecarWriter) close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.f == nil {
+		return
+	}
+	tmp := s.f.Name()
+	s.closeFile()
+	os.Remove(tmp)
+}
+
+func (s *sidecarWriter) closeFile() error {
+	err := s.w.Flush()
+	if cerr := s.f.Close(); err == nil {
+		err = cerr
+	}
+	s.f, s.w, s.enc = nil, nil, nil
+	return err
+}
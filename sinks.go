@@ -0,0 +1,215 @@
+//go:build recorder
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sinkRestartDelay is how long a failed sink waits before FFmpeg is restarted.
+const sinkRestartDelay = 5 * time.Second
+
+// sinkFlags collects the repeatable -sink flag.
+type sinkFlags []string
+
+func (s *sinkFlags) String() string { return strings.Join(*s, " ") }
+
+func (s *sinkFlags) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+var sinkSpecs sinkFlags
+
+func init() {
+	flag.Var(&sinkSpecs, "sink", "additional FFmpeg pipeline fed with every frame, as KIND:ENCODER:DIR where KIND is record or hls; may be repeated")
+}
+
+// FFmpegSink is an FFmpeg process of its own, fed with every recorded frame
+// alongside the main recording. A sink that fails is restarted without
+// affecting the others.
+type FFmpegSink struct {
+	Kind    string // record writes segments, hls writes a live HLS playlist
+	Encoder string
+	Dir     string
+
+	frames chan []byte
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+var ffmpegSinks []*FFmpegSink
+
+// parseSink parses a -sink value, e.g. "hls:libx264:hls/".
+func parseSink(spec string) (*FFmpegSink, error) {
+	parts := strings.SplitN(spec, ":", 3)
+	if len(parts) != 3 || parts[1] == "" || parts[2] == "" {
+		return nil, fmt.Errorf("sink %q: expected KIND:ENCODER:DIR", spec)
+	}
+	switch parts[0] {
+	case "record", "hls":
+	default:
+		return nil, fmt.Errorf("sink %q: unknown kind %q", spec, parts[0])
+	}
+	return &FFmpegSink{Kind: parts[0], Encoder: parts[1], Dir: filepath.Clean(parts[2])}, nil
+}
+
+// args returns the FFmpeg arguments for the sink.
+func (s *FFmpegSink) args() []string {
+	args := []string{
+		"-hide_banner",
+		"-loglevel", "level+error",
+		"-f", "mjpeg",
+		"-framerate", "15",
+		"-i", "pipe:0",
+		"-c:v", s.Encoder,
+		"-pix_fmt", "yuv420p",
+		"-b:v", recordingBitrate(),
+	}
+	if s.Kind == "hls" {
+		return append(args,
+			"-f", "hls",
+			"-hls_time", "4",
+			"-hls_list_size", "10",
+			"-hls_flags", "delete_segments",
+			filepath.Join(s.Dir, "index.m3u8"),
+		)
+	}
+	args = append(args,
+		"-f", "segment",
+		"-reset_timestamps", "1",
+		"-segment_time", strconv.Itoa(segmentDuration()),
+		"-segment_atclocktime", "1",
+		"-strftime", "1",
+	)
+	args = append(args, segmentFormatArgs()...)
+	return append(args, filepath.Join(s.Dir, "compressed_%Y%m%dT%H%M%S"+clipExt()))
+}
+
+// startSinks starts a goroutine for each -sink.
+func startSinks() error {
+	for _, spec := range sinkSpecs {
+		sink, err := parseSink(spec)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(sink.Dir, 0o755); err != nil {
+			return fmt.Errorf("create sink directory: %w", err)
+		}
+		sink.frames = make(chan []byte, 4)
+		sink.stop = make(chan struct{})
+		sink.done = make(chan struct{})
+		ffmpegSinks = append(ffmpegSinks, sink)
+		go sink.run()
+	}
+	return nil
+}
+
+// run keeps FFmpeg running for the sink, restarting it after sinkRestartDelay
+// whenever it fails, until stopSinks is called.
+func (s *FFmpegSink) run() {
+	defer close(s.done)
+	defer logPanic("sink " + s.Kind + ":" + s.Dir)
+
+	for {
+		err := s.feed()
+		select {
+		case <-s.stop:
+			return
+		default:
+		}
+		slog.Error("sink FFmpeg failed, restarting", "kind", s.Kind, "dir", s.Dir, "error", err, "delay", sinkRestartDelay)
+		select {
+		case <-s.stop:
+			return
+		case <-time.After(sinkRestartDelay):
+		}
+	}
+}
+
+// feed runs one FFmpeg process and writes frames to it until a write fails or
+// the sink is stopped. It returns why FFmpeg ended.
+func (s *FFmpegSink) feed() error {
+	cmd := exec.Command(*ffmpegPath, s.args()...)
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("create FFmpeg stdin pipe: %w", err)
+	}
+	stderr, err := pipeFFmpegLog(cmd, "sink "+s.Kind)
+	if err != nil {
+		in.Close()
+		return err
+	}
+	err = cmd.Start()
+	stderr.Close()
+	if err != nil {
+		return fmt.Errorf("start FFmpeg process: %w", err)
+	}
+	slog.Info("sink started", "kind", s.Kind, "encoder", s.Encoder, "dir", s.Dir, "pid", cmd.Process.Pid)
+
+	var writeErr error
+loop:
+	for {
+		select {
+		case <-s.stop:
+			break loop
+		case frame := <-s.frames:
+			if _, writeErr = in.Write(frame); writeErr != nil {
+				break loop
+			}
+		}
+	}
+	in.Close()
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("FFmpeg exited: %w", err)
+	}
+	if writeErr != nil {
+		return fmt.Errorf("write frame: %w", writeErr)
+	}
+	return nil
+}
+
+// writeSinkFrames hands frame to every sink, dropping it for sinks whose
+// FFmpeg is behind or restarting.
+func writeSinkFrames(frame []byte) {
+	for _, sink := range ffmpegSinks {
+		select {
+		case sink.frames <- frame:
+		default:
+			slog.Debug("sink busy, dropping frame", "kind", sink.Kind, "dir", sink.Dir)
+		}
+	}
+}
+
+// stopSinks closes the input of every sink's FFmpeg so it finishes its
+// output, waiting at most timeout for them all.
+func stopSinks(timeout time.Duration) {
+	var wg sync.WaitGroup
+	for _, sink := range ffmpegSinks {
+		close(sink.stop)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-sink.done
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		slog.Error("sinks did not finish in time", "timeout", timeout)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"image/jpeg"
+	"image/png"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+var pngCompression = flag.String("png-compression", "default", "compression of /snapshot?format=png: none, speed, default or best")
+
+// pngCompressionLevels maps -png-compression to the image/png levels.
+var pngCompressionLevels = map[string]png.CompressionLevel{
+	"none":    png.NoCompression,
+	"speed":   png.BestSpeed,
+	"default": png.DefaultCompression,
+	"best":    png.BestCompression,
+}
+
+// checkPNGCompression validates -png-compression.
+func checkPNGCompression() error {
+	if _, ok := pngCompressionLevels[*pngCompression]; !ok {
+		return fmt.Errorf("unknown PNG compression %q", *pngCompression)
+	}
+	return nil
+}
+
+var (
+	latestFrame   atomic.Pointer[[]byte] // Most recent frame from frameBroadcaster
+	latestFrameAt atomic.Int64           // Arrival of latestFrame in Unix nanoseconds
+)
+
+// storeLatestFrame records frame as the one served by /snapshot.
+func storeLatestFrame(frame []byte) {
+	latestFrame.Store(&frame)
+	latestFrameAt.Store(time.Now().UnixNano())
+}
+
+// lastFrameTime returns when the latest frame arrived, or the zero time if
+// none has.
+func lastFrameTime() time.Time {
+	at := latestFrameAt.Load()
+	if at == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, at)
+}
+
+// pushSnapshot pushes /snapshot, with the same query, to HTTP/2 clients so they
+// can show a frame before the first part of the stream arrives. It does nothing
+// when the connection does not support push.
+func pushSnapshot(w http.ResponseWriter, r *http.Request) {
+	pusher, ok := w.(http.Pusher)
+	if !ok || latestFrame.Load() == nil {
+		return
+	}
+	target := "/snapshot"
+	if r.URL.RawQuery != "" {
+		target += "?" + r.URL.RawQuery
+	}
+	if err := pusher.Push(target, nil); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		slog.Debug("failed to push snapshot", "client", r.RemoteAddr, "error", err)
+	}
+}
+
+// snapshotHandler serves the most recent frame as a single JPEG, or as a PNG
+// with ?format=png. It accepts the same ?filter=, ?width=, ?scale= and
+// ?quality= parameters as /stream.
+func snapshotHandler(w http.ResponseWriter, r *http.Request) {
+	processors, err := streamProcessors(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "jpeg" && format != "png" {
+		http.Error(w, "format must be jpeg or png", http.StatusBadRequest)
+		return
+	}
+
+	frame := latestFrame.Load()
+	if frame == nil {
+		http.Error(w, "No frame available yet", http.StatusServiceUnavailable)
+		return
+	}
+	img, err := processFrame(processors, *frame)
+	if err != nil {
+		slog.Error("failed to process snapshot", "error", err)
+		http.Error(w, "Unable to process snapshot", http.StatusInternalServerError)
+		return
+	}
+
+	contentType := "image/jpeg"
+	if format == "png" {
+		if img, err = jpegToPNG(img); err != nil {
+			slog.Error("failed to convert snapshot to PNG", "error", err)
+			http.Error(w, "Unable to convert snapshot", http.StatusInternalServerError)
+			return
+		}
+		contentType = "image/png"
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "no-store")
+	if _, err := w.Write(img); err != nil {
+		slog.Debug("failed to send snapshot", "client", r.RemoteAddr, "error", err)
+	}
+}
+
+// jpegToPNG re-encodes a JPEG frame as a PNG at the -png-compression level.
+func jpegToPNG(frame []byte) ([]byte, error) {
+	img, err := jpeg.Decode(bytes.NewReader(frame))
+	if err != nil {
+		return nil, fmt.Errorf("decode frame: %w", err)
+	}
+	var buf bytes.Buffer
+	enc := png.Encoder{CompressionLevel: pngCompressionLevels[*pngCompression]}
+	if err := enc.Encode(&buf, img); err != nil {
+		return nil, fmt.Errorf("encode PNG: %w", err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,158 @@
+//go:build recorder
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	stateFile   = flag.String("state-file", "", "JSON file tracking the recording, e.g. /tmp/picamera.state, used to check and repair the segment interrupted by a crash (empty disables)")
+	ffprobePath = flag.String("ffprobe-path", "ffprobe", "ffprobe binary used to check segments left behind by a crash")
+)
+
+// recorderState is the content of -state-file.
+type recorderState struct {
+	LastSegment   string    `json:"last_segment,omitempty"`  // Last segment FFmpeg finished
+	RecordingDir  string    `json:"recording_dir,omitempty"` // Directory of the segment being written
+	RecordedSince time.Time `json:"recorded_since,omitempty"`
+	Updated       time.Time `json:"updated"`
+}
+
+var (
+	stateMutex sync.Mutex
+	state      recorderState
+)
+
+// updateState applies update to the recorder state and writes it to
+// -state-file, replacing the file atomically.
+func updateState(update func(*recorderState)) {
+	if *stateFile == "" {
+		return
+	}
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+
+	update(&state)
+	state.Updated = time.Now()
+	b, err := json.Marshal(state)
+	if err != nil {
+		slog.Error("failed to encode state", "error", err)
+		return
+	}
+	tmp := *stateFile + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		slog.Error("failed to write state file", "path", tmp, "error", err)
+		return
+	}
+	if err := os.Rename(tmp, *stateFile); err != nil {
+		slog.Error("failed to write state file", "path", *stateFile, "error", err)
+	}
+}
+
+// loadState reads -state-file and returns the segments that may have been
+// interrupted: the last finished one and any written after it. It must be
+// called before recording starts, so new segments are not mistaken for them.
+func loadState() ([]string, error) {
+	if *stateFile == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(*stateFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, fmt.Errorf("%s: %w", *stateFile, err)
+	}
+
+	var segments []string
+	if state.LastSegment != "" {
+		segments = append(segments, state.LastSegment)
+	}
+	if state.RecordingDir == "" {
+		return segments, nil
+	}
+	entries, err := os.ReadDir(state.RecordingDir)
+	if err != nil {
+		return segments, nil
+	}
+	for _, entry := range entries {
+		path := filepath.Join(state.RecordingDir, entry.Name())
+		info, err := entry.Info()
+		if err != nil || entry.IsDir() || filepath.Ext(path) != clipExt() || path == state.LastSegment {
+			continue
+		}
+		// Written after the last update, so FFmpeg never reported it finished
+		if info.ModTime().After(state.Updated) {
+			segments = append(segments, path)
+		}
+	}
+	return segments, nil
+}
+
+// checkSegment reports whether ffprobe can read the duration of the segment
+// at path without errors.
+func checkSegment(path string) error {
+	out, err := exec.Command(*ffprobePath,
+		"-v", "error",
+		"-show_entries", "format=duration",
+		"-of", "default=noprint_wrappers=1:nokey=1",
+		path,
+	).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ffprobe: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	if lines := strings.Fields(string(out)); len(lines) != 1 || lines[0] == "N/A" {
+		return fmt.Errorf("ffprobe: %s", strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// repairSegment remuxes the segment at path with FFmpeg, keeping every packet
+// that can still be read, and replaces it with the result.
+func repairSegment(path string) error {
+	ext := filepath.Ext(path)
+	repaired := strings.TrimSuffix(path, ext) + ".repaired" + ext
+	out, err := exec.Command(*ffmpegPath, "-hide_banner", "-loglevel", "error", "-y", "-i", path, "-c", "copy", repaired).CombinedOutput()
+	if err != nil {
+		os.Remove(repaired)
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return os.Rename(repaired, path)
+}
+
+// recoverSegments checks each segment with ffprobe and repairs those that are
+// corrupt.
+func recoverSegments(segments []string) {
+	defer logPanic("recoverSegments")
+
+	for _, path := range segments {
+		err := checkSegment(path)
+		if err == nil {
+			slog.Debug("segment from previous run is intact", "path", path)
+			continue
+		}
+		slog.Warn("segment from previous run is corrupt, repairing", "path", path, "error", err)
+		if err := repairSegment(path); err != nil {
+			slog.Error("failed to repair segment", "path", path, "error", err)
+			continue
+		}
+		slog.Info("repaired segment", "path", path)
+	}
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	clipStoreKind = flag.String("clip-store", "local", "clip storage backend: local, nfs (-video-dir on an NFS mount) or s3")
+	s3Bucket      = flag.String("s3-bucket", "", "S3 bucket holding clips")
+	s3Prefix      = flag.String("s3-prefix", "", "key prefix for clips in the S3 bucket")
+	s3Endpoint    = flag.String("s3-endpoint", "", "S3-compatible endpoint URL (empty for AWS)")
+	s3Region      = flag.String("s3-region", "us-east-1", "S3 region")
+	s3Key         = flag.String("s3-key", "", "S3 access key (empty to use the default AWS credential chain)")
+	s3Secret      = flag.String("s3-secret", "", "S3 secret key")
+)
+
+// codecDirs are the subdirectories clips are sorted into by -organize-by-codec.
+var codecDirs = []string{"h264", "h265", "copy"}
+
+// ClipInfo describes a stored clip. Clips in a codec subdirectory are named
+// with the subdirectory, e.g. "h264/compressed_20240101T000000.mkv".
+type ClipInfo struct {
+	Name    string
+	Codec   string // Codec subdirectory, empty for clips at the top level
+	Size    int64
+	ModTime time.Time
+}
+
+// clipCodec returns the codec subdirectory a clip name starts with, or "" if
+// it is not inside one.
+func clipCodec(name string) string {
+	codec, _, found := strings.Cut(name, "/")
+	if !found || !slices.Contains(codecDirs, codec) {
+		return ""
+	}
+	return codec
+}
+
+// ClipStore is a storage backend for recorded clips.
+type ClipStore interface {
+	// Create returns a writer for a new clip called name. The clip appears,
+	// replacing any clip of that name, once the writer is closed without error.
+	Create(name string) (ClipWriter, error)
+	Write(name string, r io.Reader) error
+	Read(name string) (io.ReadCloser, error)
+	Delete(name string) error
+	List() ([]ClipInfo, error)
+}
+
+// ClipWriter is a clip being written to a ClipStore. Close stores the clip and
+// CloseWithError discards it.
+type ClipWriter interface {
+	io.WriteCloser
+	CloseWithError(err error) error
+}
+
+// newClipStore creates the clip store selected by the -clip-store flag.
+func newClipStore() (ClipStore, error) {
+	switch *clipStoreKind {
+	case "local":
+		return &LocalClipStore{Dir: videoDir}, nil
+	case "nfs":
+		return newNFSClipStore(videoDir)
+	case "s3":
+		return newS3ClipStore(context.Background())
+	default:
+		return nil, fmt.Errorf("unknown clip store %q", *clipStoreKind)
+	}
+}
+
+// LocalClipStore keeps clips as files in a directory.
+type LocalClipStore struct {
+	Dir string
+}
+
+// errClipDiscarded fails the upload of a clip discarded with CloseWithError.
+var errClipDiscarded = errors.New("clip discarded")
+
+// errInvalidClipName is returned for clip names that resolve outside the clip
+// directory.
+var errInvalidClipName = errors.New("invalid clip name")
+
+// path returns the file of the clip called name. Names that escape Dir, through
+// ".." or a symlink to somewhere else, are refused with errInvalidClipName.
+func (s *LocalClipStore) path(name string) (string, error) {
+	dir := filepath.Clean(s.Dir)
+	file := filepath.Join(dir, filepath.FromSlash(name))
+	if !strings.HasPrefix(file, dir+string(filepath.Separator)) {
+		return "", errInvalidClipName
+	}
+
+	resolved, err := filepath.EvalSymlinks(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return file, nil // A clip about to be written, or a 404
+	}
+	if err != nil {
+		return "", err
+	}
+	resolvedDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(resolved, resolvedDir+string(filepath.Separator)) {
+		return "", errInvalidClipName
+	}
+	return file, nil
+}
+
+// Create writes the clip to a temporary file in Dir, renamed to the clip when
+// closed, so readers never see a partial clip.
+func (s *LocalClipStore) Create(name string) (ClipWriter, error) {
+	return s.create(name)
+}
+
+func (s *LocalClipStore) create(name string) (*localClipWriter, error) {
+	file, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		return nil, err
+	}
+	tmp, err := os.CreateTemp(s.Dir, ".upload-*")
+	if err != nil {
+		return nil, fmt.Errorf("create temp file: %w", err)
+	}
+	return &localClipWriter{File: tmp, name: name, dst: file}, nil
+}
+
+// localClipWriter is a clip being written to a temporary file.
+type localClipWriter struct {
+	*os.File
+	name string
+	dst  string
+}
+
+func (w *localClipWriter) Close() error {
+	defer os.Remove(w.File.Name())
+	if err := w.File.Close(); err != nil {
+		return fmt.Errorf("close %s: %w", w.name, err)
+	}
+	return os.Rename(w.File.Name(), w.dst)
+}
+
+func (w *localClipWriter) CloseWithError(error) error {
+	w.File.Close()
+	return os.Remove(w.File.Name())
+}
+
+func (s *LocalClipStore) Write(name string, r io.Reader) error {
+	w, err := s.create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.CloseWithError(err)
+		return fmt.Errorf("write %s: %w", name, err)
+	}
+	return w.Close()
+}
+
+func (s *LocalClipStore) Read(name string) (io.ReadCloser, error) {
+	file, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(file)
+}
+
+func (s *LocalClipStore) Delete(name string) error {
+	file, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(file)
+}
+
+// List returns the clips in Dir and its subdirectories, such as the codec
+// subdirectories or the date directories of -segment-name. Hidden files, such
+// as clips still being written by Create, are left out.
+func (s *LocalClipStore) List() ([]ClipInfo, error) {
+	var clips []ClipInfo
+	err := filepath.WalkDir(s.Dir, func(file string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(s.Dir, file)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		clips = append(clips, ClipInfo{Name: name, Codec: clipCodec(name), Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+	return clips, err
+}
+
+// NFSClipStore keeps clips as files in a directory on an NFS mount. NFS is
+// transparent to file operations, so it only differs from LocalClipStore in
+// checking the mount when created: clips recorded to a directory whose share
+// failed to mount would silently fill the local disk instead.
+type NFSClipStore struct {
+	LocalClipStore
+}
+
+// newNFSClipStore creates an NFSClipStore for dir, which must be on NFS.
+func newNFSClipStore(dir string) (*NFSClipStore, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(dir, &st); err != nil {
+		return nil, fmt.Errorf("nfs clip store: %w", err)
+	}
+	if st.Type != unix.NFS_SUPER_MAGIC {
+		return nil, fmt.Errorf("nfs clip store: %s is not on an NFS mount", dir)
+	}
+	return &NFSClipStore{LocalClipStore{Dir: dir}}, nil
+}
+
+// recordingRoot returns the directory FFmpeg records segments into: the
+// directory of a clip store keeping clips as files, or else -video-dir, where
+// segments wait to be copied into the store by the segment uploader.
+func recordingRoot() string {
+	if dir, ok := localClipDir(clipStore); ok {
+		return dir
+	}
+	return videoDir
+}
+
+// localClipDir returns the directory of store if it keeps clips as files.
+func localClipDir(store ClipStore) (string, bool) {
+	switch s := store.(type) {
+	case *LocalClipStore:
+		return s.Dir, true
+	case *NFSClipStore:
+		return s.Dir, true
+	default:
+		return "", false
+	}
+}
+
+// s3PartSize is the size of the parts of multipart uploads. Clips are streamed
+// to the bucket, so the uploader holds a whole part in memory, and clips
+// smaller than a part are uploaded with a single request. A 100 MB threshold
+// would need a 100 MB buffer, too much for a Pi, so multipart starts at 16 MB.
+const s3PartSize = 16 << 20
+
+// S3ClipStore keeps clips as objects in an S3-compatible bucket.
+type S3ClipStore struct {
+	client   *s3.Client
+	uploader *manager.Uploader
+	bucket   string
+	prefix   string
+}
+
+// newS3ClipStore creates an S3ClipStore from the -s3-* flags.
+func newS3ClipStore(ctx context.Context) (*S3ClipStore, error) {
+	if *s3Bucket == "" {
+		return nil, errors.New("s3 clip store requires -s3-bucket")
+	}
+
+	opts := []func(*config.LoadOptions) error{config.WithRegion(*s3Region)}
+	if *s3Key != "" {
+		opts = append(opts, config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(*s3Key, *s3Secret, "")))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("load s3 config: %w", err)
+	}
+
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if *s3Endpoint != "" {
+			o.BaseEndpoint = aws.String(*s3Endpoint)
+			o.UsePathStyle = true
+		}
+	})
+	return &S3ClipStore{
+		client: client,
+		uploader: manager.NewUploader(client, func(u *manager.Uploader) {
+			u.PartSize = s3PartSize
+			u.Concurrency = 1 // Parts are buffered in memory
+		}),
+		bucket: *s3Bucket,
+		prefix: *s3Prefix,
+	}, nil
+}
+
+func (s *S3ClipStore) key(name string) string {
+	return path.Join(s.prefix, name)
+}
+
+func (s *S3ClipStore) Write(name string, r io.Reader) error {
+	_, err := s.uploader.Upload(context.Background(), &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(name)),
+		Body:   r,
+	})
+	if err != nil {
+		return fmt.Errorf("upload %s: %w", name, err)
+	}
+	return nil
+}
+
+// Create streams the clip to the bucket as it is written. The upload finishes,
+// or fails, when the writer is closed.
+func (s *S3ClipStore) Create(name string) (ClipWriter, error) {
+	r, w := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		defer logPanic("S3ClipStore upload")
+		err := s.Write(name, r)
+		r.CloseWithError(err) // Unblocks writes after a failed upload
+		done <- err
+	}()
+	return &s3ClipWriter{PipeWriter: w, done: done}, nil
+}
+
+// s3ClipWriter is a clip being uploaded to S3.
+type s3ClipWriter struct {
+	*io.PipeWriter
+	done <-chan error
+}
+
+func (w *s3ClipWriter) Close() error {
+	w.PipeWriter.Close()
+	return <-w.done
+}
+
+// CloseWithError fails the upload, so no object is stored.
+func (w *s3ClipWriter) CloseWithError(err error) error {
+	if err == nil {
+		err = errClipDiscarded // A nil error would complete the upload
+	}
+	w.PipeWriter.CloseWithError(err)
+	<-w.done
+	return nil
+}
+
+func (s *S3ClipStore) Read(name string) (io.ReadCloser, error) {
+	out, err := s.client.GetObject(context.Background(), &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(name)),
+	})
+	if err != nil {
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return nil, fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+		}
+		return nil, fmt.Errorf("get %s: %w", name, err)
+	}
+	return &s3ClipReader{ReadCloser: out.Body, size: aws.ToInt64(out.ContentLength)}, nil
+}
+
+// s3ClipReader is the body of a clip read from S3, with its size.
+type s3ClipReader struct {
+	io.ReadCloser
+	size int64
+}
+
+// Size returns the size of the clip in bytes.
+func (r *s3ClipReader) Size() int64 {
+	return r.size
+}
+
+func (s *S3ClipStore) Delete(name string) error {
+	_, err := s.client.DeleteObject(context.Background(), &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(name)),
+	})
+	if err != nil {
+		return fmt.Errorf("delete %s: %w", name, err)
+	}
+	return nil
+}
+
+// s3ClipName returns the name of the clip stored under key, which is below
+// prefix. Like LocalClipStore, it accepts names in nested directories, such as
+// those of a -segment-name template, but not directory markers or dotfiles.
+func s3ClipName(key, prefix string) (string, bool) {
+	name, ok := strings.CutPrefix(key, prefix)
+	if !ok || name == "" || strings.HasSuffix(name, "/") || strings.HasPrefix(path.Base(name), ".") {
+		return "", false
+	}
+	return name, true
+}
+
+func (s *S3ClipStore) List() ([]ClipInfo, error) {
+	prefix := s.prefix
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	var clips []ClipInfo
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(context.Background())
+		if err != nil {
+			return nil, fmt.Errorf("list objects: %w", err)
+		}
+		for _, obj := range page.Contents {
+			name, ok := s3ClipName(aws.ToString(obj.Key), prefix)
+			if !ok {
+				continue
+			}
+			clips = append(clips, ClipInfo{Name: name, Codec: clipCodec(name), Size: aws.ToInt64(obj.Size), ModTime: aws.ToTime(obj.LastModified)})
+		}
+	}
+	return clips, nil
+}
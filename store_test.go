@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocalClipStoreCreate(t *testing.T) {
+	dir := t.TempDir()
+	store := &LocalClipStore{Dir: dir}
+
+	w, err := store.Create("h264/clip.mkv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, "segment"); err != nil {
+		t.Fatal(err)
+	}
+	if clips, err := store.List(); err != nil || len(clips) != 0 {
+		t.Fatalf("List before Close = %v, %v, want no clips", clips, err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := store.Read("h264/clip.mkv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(r)
+	r.Close()
+	if err != nil || string(data) != "segment" {
+		t.Fatalf("Read = %q, %v, want %q", data, err, "segment")
+	}
+
+	w, err = store.Create("discarded.mkv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, "partial")
+	w.CloseWithError(errors.New("source failed"))
+	if _, err := os.Stat(filepath.Join(dir, "discarded.mkv")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("discarded clip exists: %v", err)
+	}
+
+	clips, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clips) != 1 || clips[0].Name != "h264/clip.mkv" || clips[0].Codec != "h264" {
+		t.Errorf("List = %+v, want only h264/clip.mkv", clips)
+	}
+
+	if _, err := store.Create("../escape.mkv"); !errors.Is(err, errInvalidClipName) {
+		t.Errorf("Create outside Dir: err = %v, want errInvalidClipName", err)
+	}
+}
+
+func TestS3ClipName(t *testing.T) {
+	tests := []struct {
+		key, prefix string
+		want        string
+		wantOK      bool
+	}{
+		{"clip.mkv", "", "clip.mkv", true},
+		{"cam/clip.mkv", "cam/", "clip.mkv", true},
+		{"h264/clip.mkv", "", "h264/clip.mkv", true},
+		{"cam/2026/10/15/clip_20261015T120000.mkv", "cam/", "2026/10/15/clip_20261015T120000.mkv", true},
+		{"cam/", "cam/", "", false},
+		{"cam/2026/10/", "cam/", "", false},
+		{"cam/2026/.upload-123", "cam/", "", false},
+		{"other/clip.mkv", "cam/", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := s3ClipName(tt.key, tt.prefix)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("s3ClipName(%q, %q) = %q, %v, want %q, %v", tt.key, tt.prefix, got, ok, tt.want, tt.wantOK)
+		}
+	}
+	if codec := clipCodec("h264/2026/10/15/clip.mkv"); codec != "h264" {
+		t.Errorf("clipCodec of a templated name in h264 = %q, want h264", codec)
+	}
+}
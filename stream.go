@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"time"
+)
+
+var (
+	streamWriteTimeoutMs = flag.Int("stream-write-timeout-ms", 500, "close a stream client whose frame write takes longer than this many milliseconds (0 disables)")
+	streamBoundary       = flag.String("boundary", "", "multipart boundary for /stream (empty generates a random one per client)")
+)
+
+// checkBoundary validates -boundary.
+func checkBoundary() error {
+	if *streamBoundary == "" {
+		return nil
+	}
+	return multipart.NewWriter(io.Discard).SetBoundary(*streamBoundary)
+}
+
+// newStreamWriter returns the multipart writer for a stream response, using
+// -boundary when it is set.
+func newStreamWriter(w io.Writer) *multipart.Writer {
+	mw := multipart.NewWriter(w)
+	if *streamBoundary != "" {
+		mw.SetBoundary(*streamBoundary) // Validated by checkBoundary at startup
+	}
+	return mw
+}
+
+// warnBoundaryCollision logs a warning if frame contains the multipart
+// boundary, which makes clients split the frame in two.
+func warnBoundaryCollision(frame []byte, boundary string) {
+	if bytes.Contains(frame, []byte("--"+boundary)) {
+		slog.Warn("frame contains the multipart boundary", "boundary", boundary)
+	}
+}
+
+// writeWithDeadline writes frame to part and flushes it to the client. The write
+// fails with os.ErrDeadlineExceeded if the client does not accept it within
+// -stream-write-timeout-ms, or -write-timeout when that is disabled.
+func writeWithDeadline(rc *http.ResponseController, part io.Writer, frame []byte) error {
+	if *streamWriteTimeoutMs > 0 {
+		deadline := time.Now().Add(time.Duration(*streamWriteTimeoutMs) * time.Millisecond)
+		if err := rc.SetWriteDeadline(deadline); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			return err
+		}
+	} else {
+		extendWriteDeadline(rc)
+	}
+
+	if _, err := part.Write(frame); err != nil {
+		return err
+	}
+	if err := rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const systemInfoTTL = time.Second
+
+// Bits of the vcgencmd get_throttled register that mean the CPU is being
+// throttled right now.
+const (
+	throttledNow     = 0x4
+	softTempLimitNow = 0x8
+)
+
+// systemInfo is the Raspberry Pi hardware status. Fields that cannot be read on
+// this machine are left out.
+type systemInfo struct {
+	CPUTempCelsius    *float64  `json:"cpu_temp_celsius,omitempty"`
+	CPUFreqMHz        *float64  `json:"cpu_freq_mhz,omitempty"`
+	MemFreeBytes      *uint64   `json:"mem_free_bytes,omitempty"`
+	MemAvailableBytes *uint64   `json:"mem_available_bytes,omitempty"`
+	LoadAverage       []float64 `json:"load_average,omitempty"`
+	SDWrites          *uint64   `json:"sd_writes,omitempty"`
+	ThermalThrottling *bool     `json:"thermal_throttling,omitempty"`
+	Timestamp         time.Time `json:"timestamp"`
+}
+
+var (
+	systemInfoMutex  sync.Mutex
+	cachedSystemInfo *systemInfo
+)
+
+// systemHandler serves the hardware status, read at most once per systemInfoTTL.
+func systemHandler(w http.ResponseWriter, r *http.Request) {
+	systemInfoMutex.Lock()
+	if cachedSystemInfo == nil || time.Since(cachedSystemInfo.Timestamp) > systemInfoTTL {
+		cachedSystemInfo = readSystemInfo()
+	}
+	info := cachedSystemInfo
+	systemInfoMutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(info); err != nil {
+		slog.Error("failed to encode system info", "error", err)
+	}
+}
+
+// readSystemInfo collects the hardware status from /sys, /proc and vcgencmd.
+func readSystemInfo() *systemInfo {
+	info := &systemInfo{Timestamp: time.Now()}
+
+	if milli, err := readUintFile("/sys/class/thermal/thermal_zone0/temp"); err == nil {
+		temp := float64(milli) / 1000
+		info.CPUTempCelsius = &temp
+	}
+	if khz, err := readUintFile("/sys/devices/system/cpu/cpu0/cpufreq/scaling_cur_freq"); err == nil {
+		freq := float64(khz) / 1000
+		info.CPUFreqMHz = &freq
+	}
+	if mem, err := readMeminfo(); err == nil {
+		if free, ok := mem["MemFree"]; ok {
+			info.MemFreeBytes = &free
+		}
+		if avail, ok := mem["MemAvailable"]; ok {
+			info.MemAvailableBytes = &avail
+		}
+	}
+	if load, err := readLoadAverage(); err == nil {
+		info.LoadAverage = load
+	}
+	if writes, err := readSDWrites(); err == nil {
+		info.SDWrites = &writes
+	}
+	if throttled, err := readThrottled(); err == nil {
+		thermal := throttled&(throttledNow|softTempLimitNow) != 0
+		info.ThermalThrottling = &thermal
+	} else {
+		slog.Debug("failed to read throttle state", "error", err)
+	}
+	return info
+}
+
+func readUintFile(path string) (uint64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// readMeminfo returns the /proc/meminfo entries in bytes.
+func readMeminfo() (map[string]uint64, error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	mem := make(map[string]uint64)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(value)
+		if len(fields) == 0 {
+			continue
+		}
+		n, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		if len(fields) > 1 && fields[1] == "kB" {
+			n *= 1024
+		}
+		mem[key] = n
+	}
+	return mem, scanner.Err()
+}
+
+// readLoadAverage returns the 1, 5 and 15 minute load averages.
+func readLoadAverage() ([]float64, error) {
+	data, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 3 {
+		return nil, fmt.Errorf("unexpected /proc/loadavg format %q", data)
+	}
+
+	load := make([]float64, 3)
+	for i := range load {
+		if load[i], err = strconv.ParseFloat(fields[i], 64); err != nil {
+			return nil, err
+		}
+	}
+	return load, nil
+}
+
+// readSDWrites returns the number of write requests completed by the SD card
+// since boot, the fifth field of its block device stat file.
+func readSDWrites() (uint64, error) {
+	data, err := os.ReadFile("/sys/block/mmcblk0/stat")
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 5 {
+		return 0, errors.New("unexpected mmcblk0 stat format")
+	}
+	return strconv.ParseUint(fields[4], 10, 64)
+}
+
+// readThrottled parses the output of vcgencmd get_throttled, e.g. "throttled=0x50005".
+func readThrottled() (uint64, error) {
+	out, err := exec.Command("vcgencmd", "get_throttled").Output()
+	if err != nil {
+		return 0, err
+	}
+	_, value, ok := strings.Cut(strings.TrimSpace(string(out)), "=")
+	if !ok {
+		return 0, fmt.Errorf("unexpected vcgencmd output %q", out)
+	}
+	return strconv.ParseUint(value, 0, 64)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var thumbDir = "thumbs" // Directory holding generated clip thumbnails, served under /thumbs/
+
+// Missing thumbnails are generated by thumbnailWorkers workers from a queue of
+// thumbnailQueueSize clips. A clip whose thumbnail failed is tried again after
+// thumbnailRetryInterval.
+const (
+	thumbnailWorkers       = 2
+	thumbnailQueueSize     = 64
+	thumbnailRetryInterval = 10 * time.Minute
+)
+
+// thumbnail is the state of a clip's thumbnail.
+type thumbnail struct {
+	url   string    // "" while generating or after a failure
+	retry time.Time // When to try again after a failure, zero while generating
+}
+
+// thumbnailJob asks for the thumbnail of clip to be made from the file src.
+type thumbnailJob struct {
+	clip, src string
+}
+
+var (
+	thumbnails      = make(map[string]thumbnail) // By clip name
+	thumbnailsMutex sync.Mutex
+
+	thumbnailQueue        = make(chan thumbnailJob, thumbnailQueueSize)
+	startThumbnailWorkers sync.Once
+)
+
+// thumbnailName returns the path of clip's thumbnail relative to thumbDir.
+func thumbnailName(clip string) string {
+	return strings.TrimSuffix(clip, path.Ext(clip)) + ".jpg"
+}
+
+// generateThumbnail saves the frame five seconds into the video file src as the
+// thumbnail of clip.
+func generateThumbnail(clip, src string) error {
+	name := thumbnailName(clip)
+	dst := filepath.Join(thumbDir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return fmt.Errorf("create thumbnail directory: %w", err)
+	}
+
+	cmd := exec.Command(*ffmpegPath,
+		"-hide_banner",
+		"-loglevel", "error",
+		"-y",
+		"-i", src,
+		"-ss", "00:00:05",
+		"-vframes", "1",
+		dst,
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("FFmpeg: %w: %s", err, bytes.TrimSpace(out))
+	}
+
+	thumbnailsMutex.Lock()
+	thumbnails[clip] = thumbnail{url: "/thumbs/" + name}
+	thumbnailsMutex.Unlock()
+	return nil
+}
+
+// thumbnailWorker generates the thumbnails queued by thumbnailURL.
+func thumbnailWorker() {
+	defer logPanic("thumbnailWorker")
+
+	for job := range thumbnailQueue {
+		if err := generateThumbnail(job.clip, job.src); err != nil {
+			slog.Warn("failed to generate thumbnail", "clip", job.clip, "retry_in", thumbnailRetryInterval, "error", err)
+			thumbnailsMutex.Lock()
+			thumbnails[job.clip] = thumbnail{retry: time.Now().Add(thumbnailRetryInterval)}
+			thumbnailsMutex.Unlock()
+		}
+	}
+}
+
+// thumbnailURL returns the URL of clip's thumbnail, or "" if there is none yet.
+// Thumbnails missing for clips in a local clip store are queued for the
+// background workers. When the queue is full the clip is queued on a later
+// call instead.
+func thumbnailURL(clip string) string {
+	thumbnailsMutex.Lock()
+	defer thumbnailsMutex.Unlock()
+	if t, ok := thumbnails[clip]; ok && (t.url != "" || t.retry.IsZero() || time.Now().Before(t.retry)) {
+		return t.url
+	}
+
+	name := thumbnailName(clip)
+	if _, err := os.Stat(filepath.Join(thumbDir, filepath.FromSlash(name))); err == nil {
+		thumbnails[clip] = thumbnail{url: "/thumbs/" + name}
+		return thumbnails[clip].url
+	}
+
+	dir, ok := localClipDir(clipStore)
+	if !ok {
+		return ""
+	}
+	startThumbnailWorkers.Do(func() {
+		for range thumbnailWorkers {
+			go thumbnailWorker()
+		}
+	})
+	select {
+	case thumbnailQueue <- thumbnailJob{clip: clip, src: filepath.Join(dir, filepath.FromSlash(clip))}:
+		thumbnails[clip] = thumbnail{}
+	default:
+	}
+	return ""
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+var snapshotDir = flag.String("snapshot-dir", "snapshots", "directory of JPEG snapshots used by /api/clips/from-snapshots")
+
+// timelapseEncoders maps the codec query parameter to an FFmpeg encoder.
+var timelapseEncoders = map[string]string{
+	"h264": "libx264",
+	"h265": "libx265",
+}
+
+const maxTimelapseFPS = 60
+
+// timelapseHandler encodes every JPEG in -snapshot-dir into a new clip at
+// ?fps= frames per second (default 10) with ?codec= h264 or h265.
+func timelapseHandler(w http.ResponseWriter, r *http.Request) {
+	fps := 10
+	if s := r.URL.Query().Get("fps"); s != "" {
+		var err error
+		fps, err = strconv.Atoi(s)
+		if err != nil || fps < 1 || fps > maxTimelapseFPS {
+			http.Error(w, fmt.Sprintf("fps must be between 1 and %d", maxTimelapseFPS), http.StatusBadRequest)
+			return
+		}
+	}
+	codec := r.URL.Query().Get("codec")
+	if codec == "" {
+		codec = "h264"
+	}
+	encoder, ok := timelapseEncoders[codec]
+	if !ok {
+		http.Error(w, "codec must be h264 or h265", http.StatusBadRequest)
+		return
+	}
+
+	snapshots, err := filepath.Glob(filepath.Join(*snapshotDir, "*.jpg"))
+	if err != nil || len(snapshots) == 0 {
+		http.Error(w, "No snapshots to encode", http.StatusNotFound)
+		return
+	}
+
+	name := "timelapse_" + time.Now().Format("20060102T150405") + clipExt()
+	w = longResponse(w) // Encoding may take longer than -write-timeout
+	if err := encodeTimelapse(name, fps, encoder); err != nil {
+		slog.Error("failed to create timelapse", "clip", name, "error", err)
+		http.Error(w, "Unable to create timelapse", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("created timelapse", "clip", name, "snapshots", len(snapshots), "fps", fps, "codec", codec)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	err = json.NewEncoder(w).Encode(map[string]any{
+		"clip":      name,
+		"snapshots": len(snapshots),
+		"url":       "/download/" + name,
+	})
+	if err != nil {
+		slog.Error("failed to encode timelapse response", "error", err)
+	}
+}
+
+// encodeTimelapse runs FFmpeg over the snapshots into a temporary file and
+// saves the result in the clip store as name.
+func encodeTimelapse(name string, fps int, encoder string) error {
+	tmp, err := os.MkdirTemp("", "timelapse-")
+	if err != nil {
+		return fmt.Errorf("create temp dir: %w", err)
+	}
+	defer os.RemoveAll(tmp)
+	out := filepath.Join(tmp, name)
+
+	cmd := exec.Command(*ffmpegPath,
+		"-hide_banner",
+		"-loglevel", "error",
+		"-framerate", strconv.Itoa(fps),
+		"-pattern_type", "glob",
+		"-i", filepath.Join(*snapshotDir, "*.jpg"),
+		"-c:v", encoder,
+		"-pix_fmt", "yuv420p",
+		out,
+	)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("FFmpeg: %w: %s", err, bytes.TrimSpace(output))
+	}
+
+	f, err := os.Open(out)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return clipStore.Write(name, f)
+}
@@ -0,0 +1,259 @@
+//go:build recorder
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	s3Upload            = flag.Bool("s3-upload", false, "upload each finished segment to the -s3-bucket, in 16 MB parts above 16 MB")
+	s3DeleteAfterUpload = flag.Bool("s3-delete-after-upload", false, "delete segments once uploaded instead of moving them to -s3-archive-dir")
+	s3ArchiveDir        = flag.String("s3-archive-dir", "archive", "directory uploaded segments are moved to")
+	s3Workers           = flag.Int("s3-workers", 3, "number of segments uploaded at the same time")
+)
+
+const (
+	uploadQueueSize = 64
+	uploadQueueWarn = 10 // Queue depth at which uploads are falling behind recording
+
+	// A failed upload is retried after minUploadRetry, doubling with each
+	// failure up to maxUploadRetry.
+	minUploadRetry = 10 * time.Second
+	maxUploadRetry = 10 * time.Minute
+)
+
+var (
+	uploadQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "s3_upload_queue_depth",
+		Help: "Finished segments waiting for an upload worker.",
+	})
+	uploadedBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "s3_upload_bytes_total",
+		Help: "Bytes of segments uploaded to S3, by upload worker.",
+	}, []string{"worker"})
+	uploadThroughput = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "s3_upload_throughput_bytes_per_second",
+		Help: "Throughput of the last segment uploaded by each upload worker.",
+	}, []string{"worker"})
+)
+
+// segmentUploader copies finished segments from the recording directory into
+// a clip store: the -clip-store when it does not keep clips in the recording
+// directory, or the -s3-bucket with -s3-upload. Segment paths are queued on
+// queue and uploaded by -s3-workers workers. Segments are never dropped:
+// those finished while queue is full wait in pending, and failed uploads are
+// queued again after a backoff.
+type segmentUploader struct {
+	store  ClipStore
+	remove bool // Delete uploaded segments instead of moving them to -s3-archive-dir
+	queue  chan string
+
+	mutex    sync.Mutex
+	pending  []string       // Segments waiting for room in queue
+	failures map[string]int // Failed uploads by segment, for the retry backoff
+	wake     chan struct{}  // Signals run that pending is not empty
+}
+
+// startSegmentUploads uploads every finished segment when the clip store is
+// not the recording directory or -s3-upload is set.
+func startSegmentUploads() error {
+	u := &segmentUploader{
+		remove:   *s3DeleteAfterUpload,
+		queue:    make(chan string, uploadQueueSize),
+		failures: make(map[string]int),
+		wake:     make(chan struct{}, 1),
+	}
+	if _, local := localClipDir(clipStore); !local {
+		u.store, u.remove = clipStore, true // The store is the only home of the clip
+	} else if *s3Upload {
+		store, err := newS3ClipStore(context.Background())
+		if err != nil {
+			return err
+		}
+		u.store = store
+	} else {
+		return nil
+	}
+	if *s3Workers < 1 {
+		return fmt.Errorf("-s3-workers must be at least 1, got %d", *s3Workers)
+	}
+	for i := range *s3Workers {
+		go u.work(strconv.Itoa(i))
+	}
+	go u.run()
+	onSegmentFinished = u.add
+	return nil
+}
+
+// add queues the segment at path for upload, warning when the queue grows past
+// uploadQueueWarn. It does not block.
+func (u *segmentUploader) add(path string) {
+	u.mutex.Lock()
+	u.pending = append(u.pending, path)
+	depth := len(u.pending) + len(u.queue)
+	u.mutex.Unlock()
+
+	uploadQueueDepth.Set(float64(depth))
+	if depth > uploadQueueWarn {
+		slog.Warn("segment uploads are falling behind recording, check the connection to S3",
+			"queued", depth, "workers", *s3Workers)
+	}
+	select {
+	case u.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run moves pending segments to the queue as the workers make room.
+func (u *segmentUploader) run() {
+	defer logPanic("segmentUploader")
+
+	for range u.wake {
+		for {
+			u.mutex.Lock()
+			if len(u.pending) == 0 {
+				u.mutex.Unlock()
+				break
+			}
+			path := u.pending[0]
+			u.pending = u.pending[1:]
+			u.mutex.Unlock()
+			u.queue <- path
+		}
+	}
+}
+
+// retry queues the segment at path again once the backoff for its failures
+// has passed, and returns the backoff.
+func (u *segmentUploader) retry(path string) time.Duration {
+	u.mutex.Lock()
+	u.failures[path]++
+	backoff := minUploadRetry << min(u.failures[path]-1, 10)
+	u.mutex.Unlock()
+
+	backoff = min(backoff, maxUploadRetry)
+	time.AfterFunc(backoff, func() { u.add(path) })
+	return backoff
+}
+
+// depth returns the number of segments waiting for a worker.
+func (u *segmentUploader) depth() int {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return len(u.pending) + len(u.queue)
+}
+
+// work uploads and retires the segments taken from the queue.
+func (u *segmentUploader) work(worker string) {
+	defer logPanic("segmentUploader worker " + worker)
+
+	for path := range u.queue {
+		uploadQueueDepth.Set(float64(u.depth()))
+		name, err := filepath.Rel(recordingRoot(), path)
+		if err != nil {
+			name = filepath.Base(path)
+		}
+		name = filepath.ToSlash(name)
+
+		started := time.Now()
+		size, err := u.upload(name, path)
+		if errors.Is(err, fs.ErrNotExist) {
+			slog.Error("segment to upload is gone", "path", path, "error", err)
+			continue
+		}
+		if err != nil {
+			slog.Error("failed to upload segment", "path", path, "worker", worker, "retry_in", u.retry(path), "error", err)
+			continue
+		}
+		u.mutex.Lock()
+		delete(u.failures, path)
+		u.mutex.Unlock()
+		uploadedBytes.WithLabelValues(worker).Add(float64(size))
+		if elapsed := time.Since(started).Seconds(); elapsed > 0 {
+			uploadThroughput.WithLabelValues(worker).Set(float64(size) / elapsed)
+		}
+		if err := u.retire(name, path); err != nil {
+			slog.Error("failed to remove uploaded segment", "path", path, "error", err)
+		}
+	}
+}
+
+// upload copies the segment at path into the store as name and returns its
+// size.
+func (u *segmentUploader) upload(name, path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := info.Size()
+
+	started := time.Now()
+	slog.Info("uploading segment", "path", path, "clip", name, "size", size)
+
+	w, err := u.store.Create(name)
+	if err != nil {
+		return 0, fmt.Errorf("upload %s: %w", name, err)
+	}
+	if _, err := io.Copy(w, &progressReader{r: f, name: name, total: size}); err != nil {
+		w.CloseWithError(err)
+		return 0, fmt.Errorf("upload %s: %w", name, err)
+	}
+	if err := w.Close(); err != nil {
+		return 0, err
+	}
+	slog.Info("uploaded segment", "clip", name, "size", size, "elapsed", time.Since(started))
+	return size, nil
+}
+
+// retire deletes the uploaded segment at path or moves it to -s3-archive-dir
+// as name.
+func (u *segmentUploader) retire(name, path string) error {
+	if u.remove {
+		return os.Remove(path)
+	}
+	dst := filepath.Join(*s3ArchiveDir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	return os.Rename(path, dst)
+}
+
+// progressReader logs every s3PartSize bytes read during an upload.
+type progressReader struct {
+	r      io.Reader
+	name   string
+	total  int64
+	read   int64
+	logged int64
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.read += int64(n)
+	if p.read-p.logged >= s3PartSize || (err == io.EOF && p.read > p.logged) {
+		p.logged = p.read
+		slog.Info("upload progress", "clip", p.name, "sent", p.read, "size", p.total,
+			"percent", fmt.Sprintf("%.0f", 100*float64(p.read)/float64(p.total)))
+	}
+	return n, err
+}
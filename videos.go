@@ -0,0 +1,290 @@
+package main
+
+import (
+	"archive/zip"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+var videoDir = "clips" // Directory clips are recorded to and served from, set with -video-dir
+
+var container = flag.String("container", "mkv", "container format of recorded clips: mkv, mp4 or ts")
+
+// clipExt returns the file extension of clips in the -container format.
+func clipExt() string {
+	return "." + *container
+}
+
+// checkContainer validates -container.
+func checkContainer() error {
+	switch *container {
+	case "mkv", "mp4", "ts":
+		return nil
+	default:
+		return fmt.Errorf("unknown container %q", *container)
+	}
+}
+
+// clipStore holds the recorded clips served by the handlers below.
+var clipStore ClipStore
+
+// videoEntry is a row of the /videos listing.
+type videoEntry struct {
+	ClipInfo
+	Thumb string // Thumbnail URL, empty if there is none yet
+}
+
+// listVideos returns the clips in the -container format and the zip files in
+// the clip store.
+func listVideos() ([]videoEntry, error) {
+	clips, err := clipStore.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var videoFiles []videoEntry
+	for _, clip := range clips {
+		switch filepath.Ext(clip.Name) {
+		case clipExt():
+			videoFiles = append(videoFiles, videoEntry{ClipInfo: clip, Thumb: thumbnailURL(clip.Name)})
+		case ".zip":
+			videoFiles = append(videoFiles, videoEntry{ClipInfo: clip})
+		}
+	}
+	return videoFiles, nil
+}
+
+// listVideosHandler lists all clips in the -container format and zip files in
+// the clip store and provides download links.
+func listVideosHandler(w http.ResponseWriter, r *http.Request) {
+	videoFiles, err := listVideos()
+	if err != nil {
+		http.Error(w, "Unable to read directory", http.StatusInternalServerError)
+		return
+	}
+
+	// Define the HTML template for listing files
+	const tpl = `
+	<!DOCTYPE html>
+	<html>
+	<head>
+		<title>{{.Title}} - Video List</title>
+	</head>
+	<body>
+		<h1>{{.Title}}: Available Videos</h1>
+		<table border="1">
+			<tr>
+				<th>Preview</th>
+				<th>Filename</th>
+				<th>Codec</th>
+				<th>Action</th>
+			</tr>
+			{{range .Videos}}
+			<tr>
+				<td>{{if .Thumb}}<img src="{{.Thumb}}" width="160" alt="">{{end}}</td>
+				<td>{{.Name}}</td>
+				<td>{{or .Codec "-"}}</td>
+				<td>
+					<a href="/download/{{.Name}}" download>Download</a>
+					<button class="resume" data-href="/download/{{.Name}}" data-name="{{.Name}}" hidden>Resumable download</button>
+				</td>
+			</tr>
+			{{end}}
+		</table>
+		<script>
+			// A resumable download streams the clip into a file picked with the
+			// File System Access API, so it never has to fit in memory. The
+			// number of bytes saved is kept in localStorage. After an
+			// interruption, picking the same file again resumes it from its
+			// current size with a Range request. Browsers without the API only
+			// get the plain link, whose downloads they resume themselves.
+			function updateLabel(button) {
+				const offset = localStorage.getItem("download-offset:" + button.dataset.name);
+				button.textContent = offset ? "Resume from " + (offset / 1048576).toFixed(1) + " MB" : "Resumable download";
+			}
+
+			async function resumableDownload(button) {
+				const key = "download-offset:" + button.dataset.name;
+				let handle;
+				try {
+					handle = await showSaveFilePicker({suggestedName: button.dataset.name.split("/").pop()});
+				} catch (e) {
+					return; // Picker cancelled
+				}
+				button.disabled = true;
+				let file;
+				try {
+					// Without a recorded offset the picked file is overwritten
+					let start = localStorage.getItem(key) ? (await handle.getFile()).size : 0;
+					const resp = await fetch(button.dataset.href, {headers: start > 0 ? {Range: "bytes=" + start + "-"} : {}});
+					if (!resp.ok) {
+						throw new Error(resp.status + " " + resp.statusText);
+					}
+					if (resp.status !== 206) {
+						start = 0; // The server sent the whole clip
+					}
+					file = await handle.createWritable({keepExistingData: start > 0});
+					await file.truncate(start);
+					await file.seek(start);
+					const reader = resp.body.getReader();
+					for (let saved = start; ; ) {
+						const {done, value} = await reader.read();
+						if (done) {
+							break;
+						}
+						await file.write(value);
+						saved += value.length;
+						localStorage.setItem(key, saved);
+						button.textContent = (saved / 1048576).toFixed(1) + " MB";
+					}
+					await file.close();
+					file = null;
+					localStorage.removeItem(key);
+				} catch (e) {
+					alert("Download interrupted, click again and pick the same file to resume: " + e.message);
+				} finally {
+					if (file) {
+						await file.close().catch(() => {}); // Keep what was saved
+					}
+					button.disabled = false;
+					updateLabel(button);
+				}
+			}
+
+			if (window.showSaveFilePicker) {
+				for (const button of document.querySelectorAll("button.resume")) {
+					button.hidden = false;
+					updateLabel(button);
+					button.addEventListener("click", () => resumableDownload(button));
+				}
+			}
+		</script>
+	</body>
+	</html>
+	`
+
+	tmpl, err := template.New("videoList").Parse(tpl)
+	if err != nil {
+		http.Error(w, "Unable to parse template", http.StatusInternalServerError)
+		return
+	}
+
+	err = tmpl.Execute(w, map[string]any{"Title": *cameraName, "Videos": videoFiles})
+	if err != nil {
+		http.Error(w, "Unable to execute template", http.StatusInternalServerError)
+		return
+	}
+}
+
+// downloadHandler serves video files for download.
+func downloadHandler(w http.ResponseWriter, r *http.Request) {
+	fileName := r.URL.Path[len("/download/"):]
+	serveClip(w, r, fileName)
+}
+
+// serveClip sends the named clip from the clip store.
+func serveClip(w http.ResponseWriter, r *http.Request, fileName string) {
+	w = longResponse(w)
+	clip, err := clipStore.Read(fileName)
+	if errors.Is(err, fs.ErrNotExist) {
+		http.NotFound(w, r)
+		return
+	}
+	if errors.Is(err, errInvalidClipName) {
+		http.Error(w, "Invalid clip name", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Unable to read file", http.StatusInternalServerError)
+		return
+	}
+	defer clip.Close()
+
+	// Local files can be seeked, which gives range requests and Last-Modified for
+	// free. ServeContent sets Content-Length for whole and partial responses.
+	if rs, ok := clip.(io.ReadSeeker); ok {
+		w.Header().Set("Accept-Ranges", "bytes")
+		var modTime time.Time
+		if st, ok := clip.(interface{ Stat() (fs.FileInfo, error) }); ok {
+			if info, err := st.Stat(); err == nil {
+				modTime = info.ModTime()
+			}
+		}
+		http.ServeContent(w, r, fileName, modTime, rs)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Accept-Ranges", "none")
+	if sized, ok := clip.(interface{ Size() int64 }); ok {
+		w.Header().Set("Content-Length", strconv.FormatInt(sized.Size(), 10))
+	}
+	if _, err := io.Copy(w, clip); err != nil {
+		slog.Error("failed to send clip", "clip", fileName, "error", err)
+	}
+}
+
+// exportHandler streams a ZIP archive of the recorded clips last modified between
+// the from and to dates (YYYY-MM-DD, both inclusive). Clips are stored without
+// compression since they are already compressed video.
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	from, err := time.ParseInLocation("2006-01-02", r.URL.Query().Get("from"), time.Local)
+	if err != nil {
+		http.Error(w, "Invalid from date, expected YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+	to, err := time.ParseInLocation("2006-01-02", r.URL.Query().Get("to"), time.Local)
+	if err != nil {
+		http.Error(w, "Invalid to date, expected YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+	end := to.AddDate(0, 0, 1)
+
+	clips, err := clipStore.List()
+	if err != nil {
+		http.Error(w, "Unable to read directory", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="export_%s.zip"`, from.Format("2006-01-02")))
+	w.Header().Set("Transfer-Encoding", "chunked")
+
+	zw := zip.NewWriter(longResponse(w))
+	defer zw.Close()
+	for _, clip := range clips {
+		if filepath.Ext(clip.Name) != clipExt() || clip.ModTime.Before(from) || !clip.ModTime.Before(end) {
+			continue
+		}
+		if err := addClipToZip(zw, clip); err != nil {
+			// The response has started, so all we can do is cut the archive short
+			slog.Error("failed to export clip", "clip", clip.Name, "error", err)
+			return
+		}
+	}
+}
+
+// addClipToZip copies clip from the clip store into zw.
+func addClipToZip(zw *zip.Writer, clip ClipInfo) error {
+	src, err := clipStore.Read(clip.Name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := zw.CreateHeader(&zip.FileHeader{Name: clip.Name, Method: zip.Store, Modified: clip.ModTime})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	return err
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDownloadHandlerPaths(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "clips")
+	if err := os.MkdirAll(filepath.Join(dir, "h264"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		filepath.Join(dir, "clip.mp4"):         "clip",
+		filepath.Join(dir, "h264", "clip.mp4"): "h264 clip",
+		filepath.Join(root, "secret.txt"):      "secret",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(name, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		filepath.Join(dir, "escape.mp4"):   filepath.Join(root, "secret.txt"),
+		filepath.Join(dir, "relative.mp4"): "../secret.txt",
+		filepath.Join(dir, "outside"):      root,
+		filepath.Join(dir, "alias.mp4"):    filepath.Join(dir, "clip.mp4"),
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, link); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	saved := clipStore
+	clipStore = &LocalClipStore{Dir: dir}
+	t.Cleanup(func() { clipStore = saved })
+
+	tests := []struct {
+		name   string
+		target string
+		status int
+		body   string
+	}{
+		{"clip", "/download/clip.mp4", http.StatusOK, "clip"},
+		{"codec subdirectory", "/download/h264/clip.mp4", http.StatusOK, "h264 clip"},
+		{"dot dot inside directory", "/download/h264/../clip.mp4", http.StatusOK, "clip"},
+		{"missing", "/download/missing.mp4", http.StatusNotFound, ""},
+		{"dot dot", "/download/../secret.txt", http.StatusBadRequest, ""},
+		{"nested dot dot", "/download/h264/../../secret.txt", http.StatusBadRequest, ""},
+		{"encoded slash", "/download/..%2Fsecret.txt", http.StatusBadRequest, ""},
+		{"encoded dots and slash", "/download/%2E%2E%2F%2E%2E%2Fsecret.txt", http.StatusBadRequest, ""},
+		{"directory itself", "/download/.", http.StatusBadRequest, ""},
+		{"absolute path", "/download//etc/passwd", http.StatusNotFound, ""},
+		{"encoded absolute path", "/download/%2Fetc%2Fpasswd", http.StatusNotFound, ""},
+		{"symlink outside", "/download/escape.mp4", http.StatusBadRequest, ""},
+		{"relative symlink outside", "/download/relative.mp4", http.StatusBadRequest, ""},
+		{"through symlinked directory", "/download/outside/secret.txt", http.StatusBadRequest, ""},
+		{"symlink inside", "/download/alias.mp4", http.StatusOK, "clip"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			downloadHandler(rec, httptest.NewRequest(http.MethodGet, tt.target, nil))
+			if rec.Code != tt.status {
+				t.Fatalf("GET %s: status %d, want %d (%q)", tt.target, rec.Code, tt.status, rec.Body.String())
+			}
+			if tt.body != "" && rec.Body.String() != tt.body {
+				t.Errorf("GET %s: body %q, want %q", tt.target, rec.Body.String(), tt.body)
+			}
+		})
+	}
+}
+
+func TestDownloadHandlerRange(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "clip.mkv"), []byte("0123456789"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	saved := clipStore
+	clipStore = &LocalClipStore{Dir: dir}
+	t.Cleanup(func() { clipStore = saved })
+
+	tests := []struct {
+		name          string
+		rangeHeader   string
+		status        int
+		body          string
+		contentLength string
+		contentRange  string
+	}{
+		{"whole file", "", http.StatusOK, "0123456789", "10", ""},
+		{"resume from offset", "bytes=4-", http.StatusPartialContent, "456789", "6", "bytes 4-9/10"},
+		{"middle", "bytes=2-5", http.StatusPartialContent, "2345", "4", "bytes 2-5/10"},
+		{"suffix", "bytes=-3", http.StatusPartialContent, "789", "3", "bytes 7-9/10"},
+		{"past the end", "bytes=10-", http.StatusRequestedRangeNotSatisfiable, "", "", "bytes */10"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/download/clip.mkv", nil)
+			if tt.rangeHeader != "" {
+				req.Header.Set("Range", tt.rangeHeader)
+			}
+			rec := httptest.NewRecorder()
+			downloadHandler(rec, req)
+
+			if rec.Code != tt.status {
+				t.Fatalf("Range %q: status %d, want %d", tt.rangeHeader, rec.Code, tt.status)
+			}
+			if got := rec.Header().Get("Accept-Ranges"); got != "bytes" {
+				t.Errorf("Accept-Ranges = %q, want bytes", got)
+			}
+			if tt.body != "" && rec.Body.String() != tt.body {
+				t.Errorf("body %q, want %q", rec.Body.String(), tt.body)
+			}
+			if got := rec.Header().Get("Content-Length"); tt.contentLength != "" && got != tt.contentLength {
+				t.Errorf("Content-Length = %q, want %q", got, tt.contentLength)
+			}
+			if got := rec.Header().Get("Content-Range"); got != tt.contentRange {
+				t.Errorf("Content-Range = %q, want %q", got, tt.contentRange)
+			}
+		})
+	}
+}
+
+func TestPlaybackTokenRoute(t *testing.T) {
+	mux := http.NewServeMux()
+	registerRoutes(mux)
+
+	tests := []struct {
+		target string
+		status int
+		clip   string
+	}{
+		{"/api/clips/clip.mkv/playback-token", http.StatusOK, "clip.mkv"},
+		{"/api/clips/2026/10/15/clip_120000.mkv/playback-token", http.StatusOK, "2026/10/15/clip_120000.mkv"},
+		{"/api/clips/clip.mkv", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, tt.target, nil))
+		if rec.Code != tt.status {
+			t.Errorf("POST %s: status %d, want %d (%q)", tt.target, rec.Code, tt.status, rec.Body.String())
+			continue
+		}
+		if tt.clip == "" {
+			continue
+		}
+		var resp struct{ Token string }
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		playbackTokensMutex.Lock()
+		clip := playbackTokens[resp.Token].clip
+		playbackTokensMutex.Unlock()
+		if clip != tt.clip {
+			t.Errorf("POST %s: token for clip %q, want %q", tt.target, clip, tt.clip)
+		}
+	}
+}
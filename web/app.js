@@ -0,0 +1,54 @@
+const viewers = document.getElementById("viewers");
+const offline = document.getElementById("offline");
+const feed = document.getElementById("feed");
+
+// Below sdThresholdKbps, as measured by /bandwidth-test, the feed is switched
+// to a reduced stream scaled and re-encoded by the server.
+const sdThresholdKbps = 4000;
+const bandwidthTestKB = 100;
+let reduced = false;
+
+function streamURL() {
+	const params = new URLSearchParams(reduced ? {scale: "50%", quality: "60"} : {});
+	params.set("t", Date.now());
+	return "/stream?" + params;
+}
+
+async function probeBandwidth() {
+	try {
+		const start = performance.now();
+		const resp = await fetch("/bandwidth-test?size_kb=" + bandwidthTestKB, {cache: "no-store"});
+		await resp.arrayBuffer();
+		const seconds = Math.max((performance.now() - start) / 1000, 0.001);
+		reduced = resp.ok && bandwidthTestKB * 1024 * 8 / 1000 / seconds < sdThresholdKbps;
+	} catch (e) {}
+	feed.src = streamURL();
+}
+probeBandwidth();
+
+function connectEvents() {
+	const events = new EventSource("/events");
+	events.addEventListener("viewers", e => {
+		viewers.textContent = JSON.parse(e.data).count;
+	});
+	events.onerror = () => {
+		events.close();
+		setTimeout(connectEvents, 5000);
+	};
+}
+connectEvents();
+
+let wasOffline = false;
+async function checkHealth() {
+	let down = true;
+	try {
+		down = (await fetch("/healthz", {cache: "no-store"})).status === 503;
+	} catch (e) {}
+	offline.style.display = down ? "block" : "none";
+	if (wasOffline && !down) {
+		feed.src = streamURL();
+	}
+	wasOffline = down;
+}
+checkHealth();
+setInterval(checkHealth, 5000);
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+var webhookURL = flag.String("webhook-url", "", "URL to POST JSON event notifications to")
+
+var webhookClient = &http.Client{Timeout: 5 * time.Second}
+
+const webhookRetries = 3
+
+// sendWebhook POSTs payload as JSON to the configured webhook URL, retrying
+// failed deliveries with exponential backoff. The camera name is added to the
+// payload. It is a no-op when no webhook URL is configured.
+func sendWebhook(payload map[string]any) error {
+	if *webhookURL == "" {
+		return nil
+	}
+	payload["camera"] = *cameraName
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("marshal webhook payload: %w", err)
+	}
+
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		err = postWebhook(body)
+		if err == nil || attempt == webhookRetries {
+			return err
+		}
+		slog.Warn("webhook delivery failed, retrying", "attempt", attempt+1, "backoff", backoff, "error", err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func postWebhook(body []byte) error {
+	resp, err := webhookClient.Post(*webhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("post webhook: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// notifyWebhook sends payload in the background and logs delivery failures.
+func notifyWebhook(payload map[string]any) {
+	go func() {
+		defer logPanic("notifyWebhook")
+		if err := sendWebhook(payload); err != nil {
+			slog.Error("failed to send webhook", "error", err)
+		}
+	}()
+}
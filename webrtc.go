@@ -0,0 +1,182 @@
+//go:build !recorder
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+	"github.com/pion/webrtc/v4/pkg/media/h264reader"
+)
+
+var webrtcICEServers = flag.String("webrtc-ice-servers", "", "comma-separated STUN/TURN URLs for WebRTC peers (empty for LAN only)")
+
+const webrtcFrameDuration = time.Second / 15
+
+// webrtcOfferHandler answers the SDP offer in the request body with an H.264
+// video track of the camera. Frames are registered with the broadcaster like a
+// /stream client and encoded by FFmpeg once the peer connects.
+func webrtcOfferHandler(w http.ResponseWriter, r *http.Request) {
+	var offer webrtc.SessionDescription
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&offer); err != nil {
+		http.Error(w, "Invalid SDP offer", http.StatusBadRequest)
+		return
+	}
+
+	var config webrtc.Configuration
+	if *webrtcICEServers != "" {
+		config.ICEServers = []webrtc.ICEServer{{URLs: strings.Split(*webrtcICEServers, ",")}}
+	}
+	pc, err := webrtc.NewPeerConnection(config)
+	if err != nil {
+		slog.Error("failed to create peer connection", "error", err)
+		http.Error(w, "Unable to create peer connection", http.StatusInternalServerError)
+		return
+	}
+
+	track, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264}, "video", "camera")
+	if err == nil {
+		_, err = pc.AddTrack(track)
+	}
+	if err != nil {
+		pc.Close()
+		slog.Error("failed to add WebRTC video track", "error", err)
+		http.Error(w, "Unable to create video track", http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		slog.Debug("WebRTC connection state changed", "client", r.RemoteAddr, "state", state)
+		switch state {
+		case webrtc.PeerConnectionStateConnected:
+			go streamWebRTC(ctx, track, r.RemoteAddr)
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateDisconnected, webrtc.PeerConnectionStateClosed:
+			cancel()
+			pc.Close()
+		}
+	})
+
+	if err := pc.SetRemoteDescription(offer); err != nil {
+		cancel()
+		pc.Close()
+		http.Error(w, "Invalid SDP offer: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		cancel()
+		pc.Close()
+		http.Error(w, "Unable to create SDP answer: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Answer with all ICE candidates rather than trickling them
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(answer); err != nil {
+		cancel()
+		pc.Close()
+		slog.Error("failed to set local description", "error", err)
+		http.Error(w, "Unable to create SDP answer", http.StatusInternalServerError)
+		return
+	}
+	<-gathered
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(pc.LocalDescription()); err != nil {
+		slog.Error("failed to encode SDP answer", "error", err)
+	}
+}
+
+// streamWebRTC encodes the camera frames with FFmpeg and writes the H.264 NAL
+// units to track until ctx is done.
+func streamWebRTC(ctx context.Context, track *webrtc.TrackLocalStaticSample, client string) {
+	defer logPanic("streamWebRTC")
+
+	cmd := exec.CommandContext(ctx, *ffmpegPath,
+		"-hide_banner",
+		"-loglevel", "error",
+		"-f", "mjpeg",
+		"-framerate", "15",
+		"-i", "pipe:0",
+		"-c:v", "libx264",
+		"-preset", "ultrafast",
+		"-tune", "zerolatency",
+		"-profile:v", "baseline",
+		"-pix_fmt", "yuv420p",
+		"-g", "30",
+		"-bsf:v", "h264_mp4toannexb",
+		"-f", "h264",
+		"pipe:1",
+	)
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		slog.Error("failed to create FFmpeg stdin pipe", "error", err)
+		return
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		slog.Error("failed to create FFmpeg stdout pipe", "error", err)
+		return
+	}
+	if err := cmd.Start(); err != nil {
+		slog.Error("failed to start WebRTC FFmpeg process", "error", err)
+		return
+	}
+	defer cmd.Wait()
+	slog.Info("WebRTC client connected", "client", client)
+	defer slog.Info("WebRTC client disconnected", "client", client)
+
+	abort := func() { in.Close() }
+	shard, sc, clientChan := addClient(clientInfo{remoteAddr: client, connected: time.Now()}, abort)
+	go func() {
+		defer logPanic("feedWebRTC")
+		defer in.Close()
+		defer shard.removeClient(sc)
+		for {
+			select {
+			case frame, ok := <-clientChan:
+				if !ok {
+					if clientChan = shard.next(sc); clientChan == nil {
+						return
+					}
+					continue
+				}
+				if _, err := in.Write(frame); err != nil {
+					return
+				}
+				sc.lastWrite.Store(time.Now().UnixNano())
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	reader, err := h264reader.NewReader(out)
+	if err != nil {
+		slog.Error("failed to read H.264 from FFmpeg", "error", err)
+		return
+	}
+	for {
+		nal, err := reader.NextNAL()
+		if err != nil {
+			if !errors.Is(err, io.EOF) && ctx.Err() == nil {
+				slog.Error("failed to read H.264 NAL unit", "client", client, "error", err)
+			}
+			return
+		}
+		if err := track.WriteSample(media.Sample{Data: nal.Data, Duration: webrtcFrameDuration}); err != nil {
+			slog.Debug("failed to write WebRTC sample", "client", client, "error", err)
+			return
+		}
+	}
+}